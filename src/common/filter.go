@@ -0,0 +1,68 @@
+package common
+
+import (
+	"strings"
+
+	"github.com/marsmay/golib/strings2"
+)
+
+// Filter selects the report rows
+type Filter struct {
+	MinNum   int64
+	MinSize  int64
+	Kinds    []string
+	Includes []string
+	Excludes []string
+}
+
+// Match checks the prefix, type and key number of a row, the size is checked by MatchSize once it is calculated
+func (f *Filter) Match(prefix, kind string, num int64) bool {
+	if f == nil {
+		return true
+	}
+
+	if num < f.MinNum {
+		return false
+	}
+
+	return f.MatchKey(prefix, kind)
+}
+
+// MatchKey checks the type and the prefix rules of a single key, the number and size rules only apply to rows
+func (f *Filter) MatchKey(key, kind string) bool {
+	if f == nil {
+		return true
+	}
+
+	if len(f.Kinds) > 0 && !f.matchKind(kind) {
+		return false
+	}
+
+	if len(f.Includes) > 0 {
+		if ok, _ := strings2.HasPrefixs(key, f.Includes); !ok {
+			return false
+		}
+	}
+
+	if len(f.Excludes) > 0 {
+		if ok, _ := strings2.HasPrefixs(key, f.Excludes); ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (f *Filter) matchKind(kind string) bool {
+	for _, k := range f.Kinds {
+		if strings.EqualFold(k, kind) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (f *Filter) MatchSize(size int64) bool {
+	return f == nil || size >= f.MinSize
+}
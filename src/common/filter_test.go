@@ -0,0 +1,59 @@
+package common
+
+import (
+	"testing"
+)
+
+func TestFilterMatch(t *testing.T) {
+	filter := &Filter{
+		MinNum:   10,
+		MinSize:  1024,
+		Kinds:    []string{"hash", "String"},
+		Includes: []string{"user:", "order:"},
+		Excludes: []string{"user:tmp:"},
+	}
+
+	tests := []struct {
+		prefix string
+		kind   string
+		num    int64
+		ok     bool
+	}{
+		{"user:", "hash", 10, true},
+		{"order:", "string", 100, true},
+		{"user:", "hash", 9, false},
+		{"user:", "list", 10, false},
+		{"session:", "hash", 10, false},
+		{"user:tmp:", "hash", 10, false},
+		{"user:tmp2", "hash", 10, true},
+	}
+
+	for _, test := range tests {
+		if ok := filter.Match(test.prefix, test.kind, test.num); ok != test.ok {
+			t.Errorf("match of '%s' %s %d is %v, wanted %v", test.prefix, test.kind, test.num, ok, test.ok)
+		}
+	}
+
+	// the number only applies to rows
+	if !filter.MatchKey("user:1", "hash") || filter.MatchKey("user:tmp:1", "hash") {
+		t.Error("keys are matched by the number")
+	}
+
+	if filter.MatchSize(1023) || !filter.MatchSize(1024) {
+		t.Error("size isn't matched by the minimum")
+	}
+}
+
+func TestFilterEmpty(t *testing.T) {
+	var filter *Filter
+
+	if !filter.Match("user:", "hash", 0) || !filter.MatchKey("user:1", "hash") || !filter.MatchSize(0) {
+		t.Error("nil filter doesn't match all")
+	}
+
+	filter = &Filter{}
+
+	if !filter.Match("user:", "hash", 0) || !filter.MatchKey("user:1", "hash") || !filter.MatchSize(0) {
+		t.Error("empty filter doesn't match all")
+	}
+}
@@ -0,0 +1,56 @@
+package common
+
+import (
+	_ "embed"
+
+	"html/template"
+	"io"
+)
+
+// columns used as the area of the treemap, the first one found in the header is used
+var treemapColumns = []string{"total item size", "idle bytes", "idle num", "num"}
+
+var (
+	//go:embed report.html
+	htmlTemplate string
+
+	reportTemplate = template.Must(template.New("report").Parse(htmlTemplate))
+)
+
+type HtmlReporter struct {
+	writer io.WriteCloser
+	title  string
+	lines  [][]string
+}
+
+func (r *HtmlReporter) WriteLine(line []string) error {
+	r.lines = append(r.lines, line)
+	return nil
+}
+
+func (r *HtmlReporter) Close() (err error) {
+	data := struct {
+		Title     string
+		Header    []string
+		Lines     [][]string
+		SizeIndex int
+	}{Title: r.title, SizeIndex: -1}
+
+	if len(r.lines) > 0 {
+		data.Header, data.Lines = r.lines[0], r.lines[1:]
+	}
+
+	for _, column := range treemapColumns {
+		for i, name := range data.Header {
+			if name == column && data.SizeIndex < 0 {
+				data.SizeIndex = i
+			}
+		}
+	}
+
+	if err = reportTemplate.Execute(r.writer, data); err != nil {
+		return
+	}
+
+	return r.writer.Close()
+}
@@ -0,0 +1,48 @@
+package common
+
+// sizes of redis internal structures on 64 bit builds
+const DictEntrySize = 24
+const RobjSize = 16
+
+// embstr is used for strings up to this length
+const EmbstrMaxLen = 44
+
+var mallocClasses = []int64{8, 16, 32, 48, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384, 448, 512, 640, 768, 896, 1024, 1280, 1536, 1792, 2048, 2560, 3072, 3584, 4096}
+
+// MallocSize returns the size jemalloc actually allocates for n bytes
+func MallocSize(n int64) int64 {
+	for _, size := range mallocClasses {
+		if n <= size {
+			return size
+		}
+	}
+
+	return (n + 4095) / 4096 * 4096
+}
+
+// SdsSize returns the allocated size of a sds string with length n
+func SdsSize(n int64) int64 {
+	var header int64
+
+	switch {
+	case n < 1<<8:
+		header = 3
+	case n < 1<<16:
+		header = 5
+	case n < 1<<32:
+		header = 9
+	default:
+		header = 17
+	}
+
+	return MallocSize(header + n + 1)
+}
+
+// StringSize returns the allocated size of a string value object with length n
+func StringSize(n int64) int64 {
+	if n <= EmbstrMaxLen {
+		return MallocSize(RobjSize + 3 + n + 1)
+	}
+
+	return MallocSize(RobjSize) + SdsSize(n)
+}
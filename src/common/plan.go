@@ -0,0 +1,177 @@
+package common
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+const PlanVersion = 2
+
+// actions of plan entries, redis-remover only deletes exact keys, and checks their idle time again before
+const (
+	PlanDelete = "delete"
+	PlanExpire = "expire"
+)
+
+// PlanHeader is the first line of a plan file, it binds the plan to the instance it was created from
+type PlanHeader struct {
+	Version  int    `json:"version"`
+	Instance string `json:"instance"`
+	Addr     string `json:"addr"`
+	Tool     string `json:"tool"`
+	Created  string `json:"created"`
+}
+
+// PlanEntry is an action of a plan, on an exact key or on all keys starting with the prefix,
+// ttl is the suggested expiration in seconds, idle is the idle time in seconds a key must still have to be deleted
+type PlanEntry struct {
+	DB     int    `json:"db"`
+	Action string `json:"action"`
+	Key    string `json:"key,omitempty"`
+	Prefix string `json:"prefix,omitempty"`
+	TTL    int64  `json:"ttl,omitempty"`
+	Idle   int64  `json:"idle,omitempty"`
+}
+
+// InstanceHash identifies the instance by its replication id, which a master shares with its replicas,
+// so a plan created on a replica applies to the master, a restarted or failed over instance gets a new hash
+func InstanceHash(client *redis.Client) (hash string, err error) {
+	info, err := client.Info("replication").Result()
+
+	if err != nil {
+		return
+	}
+
+	replId := ParseInfo(info)["master_replid"]
+
+	if replId == "" {
+		err = fmt.Errorf("master_replid not found in INFO replication, redis 4.0+ is required")
+		return
+	}
+
+	sum := sha1.Sum([]byte(replId))
+	hash = hex.EncodeToString(sum[:8])
+	return
+}
+
+// PlanWriter writes a plan file in JSON lines, the header first and an entry per line
+type PlanWriter struct {
+	file    *os.File
+	writer  *bufio.Writer
+	encoder *json.Encoder
+}
+
+func (w *PlanWriter) Write(entry *PlanEntry) error {
+	return w.encoder.Encode(entry)
+}
+
+func (w *PlanWriter) Close() (err error) {
+	if err = w.writer.Flush(); err != nil {
+		w.file.Close()
+		return
+	}
+
+	return w.file.Close()
+}
+
+func NewPlanWriter(fileName, tool string, client *redis.Client) (writer *PlanWriter, err error) {
+	hash, err := InstanceHash(client)
+
+	if err != nil {
+		return
+	}
+
+	file, err := os.Create(fileName)
+
+	if err != nil {
+		return
+	}
+
+	buffer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(buffer)
+	encoder.SetEscapeHTML(false)
+
+	writer = &PlanWriter{file: file, writer: buffer, encoder: encoder}
+	err = encoder.Encode(&PlanHeader{
+		Version:  PlanVersion,
+		Instance: hash,
+		Addr:     client.Options().Addr,
+		Tool:     tool,
+		Created:  time.Now().Format("2006-01-02 15:04:05"),
+	})
+
+	if err != nil {
+		writer.Close()
+		writer = nil
+	}
+
+	return
+}
+
+// ReadPlan reads the entries of a plan file for the database of the client, and checks the plan was created from the instance of the client
+func ReadPlan(fileName string, client *redis.Client) (entries []*PlanEntry, err error) {
+	file, err := os.Open(fileName)
+
+	if err != nil {
+		return
+	}
+
+	defer file.Close()
+
+	decoder := json.NewDecoder(bufio.NewReader(file))
+	header := &PlanHeader{}
+
+	if err = decoder.Decode(header); err != nil {
+		err = fmt.Errorf("invalid plan header, %s", err)
+		return
+	}
+
+	if header.Version != PlanVersion {
+		err = fmt.Errorf("unsupported plan version %d", header.Version)
+		return
+	}
+
+	hash, err := InstanceHash(client)
+
+	if err != nil {
+		return
+	}
+
+	if header.Instance != hash {
+		err = fmt.Errorf("plan was created from instance '%s' (%s), not the instance '%s' (%s), or the instance was restarted since",
+			header.Addr, header.Instance, client.Options().Addr, hash)
+		return
+	}
+
+	var skipped int
+
+	for decoder.More() {
+		entry := &PlanEntry{}
+
+		if err = decoder.Decode(entry); err != nil {
+			err = fmt.Errorf("invalid plan entry, %s", err)
+			return
+		}
+
+		if entry.DB != client.Options().DB {
+			skipped++
+			continue
+		}
+
+		entries = append(entries, entry)
+	}
+
+	if skipped > 0 {
+		log.Printf("Warning: %d plan entries of other databases are skipped, run again with the url of the database", skipped)
+	}
+
+	return
+}
@@ -0,0 +1,155 @@
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var promMetrics = []struct {
+	column string
+	name   string
+	help   string
+	scale  float64
+}{
+	{"num", "keys", "Number of keys.", 1},
+	{"total item size", "bytes", "Estimated bytes of the key values.", 1},
+	{"idle num", "idle_keys", "Number of idle keys.", 1},
+	{"idle bytes", "idle_bytes", "Memory usage of idle keys in bytes.", 1},
+	{"idle bytes percent", "idle_bytes_ratio", "Ratio of the memory usage of idle keys.", 0.01},
+	{"idle percent", "idle_ratio", "Ratio of idle keys.", 0.01},
+	{"avg ttl", "avg_ttl_seconds", "Average ttl in seconds, -1 means no expiration.", 1},
+}
+
+var promLabels = []struct {
+	column string
+	name   string
+}{
+	{"db", "db"},
+	{"prefix", "prefix"},
+	{"type", "type"},
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// PromReporter writes the gauges of the known report columns in prometheus text format
+type PromReporter struct {
+	writer    io.WriteCloser
+	namespace string
+	instance  string
+	header    []string
+	lines     [][]string
+}
+
+func (r *PromReporter) WriteLine(line []string) error {
+	if r.header == nil {
+		r.header = line
+	} else {
+		r.lines = append(r.lines, line)
+	}
+
+	return nil
+}
+
+func (r *PromReporter) Close() (err error) {
+	columns := make(map[string]int, len(r.header))
+
+	for i, name := range r.header {
+		columns[name] = i
+	}
+
+	var buf bytes.Buffer
+
+	for _, metric := range promMetrics {
+		index, ok := columns[metric.column]
+
+		if !ok {
+			continue
+		}
+
+		name := r.namespace + "_" + metric.name
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s gauge\n", name, metric.help, name)
+
+		for _, line := range r.lines {
+			value, e := strconv.ParseFloat(strings.TrimSuffix(line[index], "%"), 64)
+
+			if e != nil {
+				continue
+			}
+
+			labels := []string{fmt.Sprintf(`instance="%s"`, labelEscaper.Replace(r.instance))}
+
+			for _, label := range promLabels {
+				if i, ok := columns[label.column]; ok {
+					labels = append(labels, fmt.Sprintf(`%s="%s"`, label.name, labelEscaper.Replace(line[i])))
+				}
+			}
+
+			fmt.Fprintf(&buf, "%s{%s} %s\n", name, strings.Join(labels, ","), strconv.FormatFloat(value*metric.scale, 'g', -1, 64))
+		}
+	}
+
+	if _, err = r.writer.Write(buf.Bytes()); err != nil {
+		return
+	}
+
+	return r.writer.Close()
+}
+
+var metricsServer *MetricsServer
+
+// MetricsServer serves the latest report written to output Metrics
+type MetricsServer struct {
+	mutex sync.RWMutex
+	body  []byte
+}
+
+func (s *MetricsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.RLock()
+	body := s.body
+	s.mutex.RUnlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = w.Write(body)
+}
+
+type metricsWriter struct {
+	bytes.Buffer
+	server *MetricsServer
+}
+
+func (w *metricsWriter) Close() error {
+	w.server.mutex.Lock()
+	w.server.body = w.Bytes()
+	w.server.mutex.Unlock()
+	return nil
+}
+
+func newMetricsWriter() (writer io.WriteCloser, err error) {
+	if metricsServer == nil {
+		err = fmt.Errorf("metrics server is not started")
+		return
+	}
+
+	writer = &metricsWriter{server: metricsServer}
+	return
+}
+
+// ServeMetrics starts a http server on listen address, serving the latest report written to output Metrics on /metrics
+func ServeMetrics(listen string) {
+	metricsServer = &MetricsServer{}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsServer)
+
+	go func() {
+		if err := http.ListenAndServe(listen, mux); err != nil {
+			log.Fatalf("Fatal Error: serve metrics failed, listen '%s', %s", listen, err)
+		}
+	}()
+}
@@ -0,0 +1,183 @@
+package common
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis"
+)
+
+// ParseInfo parses the output of INFO into a field map
+func ParseInfo(info string) map[string]string {
+	fields := make(map[string]string, 64)
+
+	for _, line := range strings.Split(info, "\n") {
+		line = strings.TrimSpace(line)
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if i := strings.IndexByte(line, ':'); i > 0 {
+			fields[line[:i]] = line[i+1:]
+		}
+	}
+
+	return fields
+}
+
+// ParseInfoValue parses a composite INFO value like "keys=1,expires=0,avg_ttl=0"
+func ParseInfoValue(value string) map[string]string {
+	fields := make(map[string]string, 8)
+
+	for _, item := range strings.Split(value, ",") {
+		if i := strings.IndexByte(item, '='); i > 0 {
+			fields[item[:i]] = item[i+1:]
+		}
+	}
+
+	return fields
+}
+
+// KeyspaceDBs returns the populated databases of the instance from INFO keyspace
+func KeyspaceDBs(client *redis.Client) (dbs []int, err error) {
+	info, err := client.Info("keyspace").Result()
+
+	if err != nil {
+		return
+	}
+
+	for name := range ParseInfo(info) {
+		if !strings.HasPrefix(name, "db") {
+			continue
+		}
+
+		if db, e := strconv.Atoi(strings.TrimPrefix(name, "db")); e == nil {
+			dbs = append(dbs, db)
+		}
+	}
+
+	sort.Ints(dbs)
+	return
+}
+
+// NewDBClients creates a client for each database, sharing the other options
+func NewDBClients(options *redis.Options, dbs []int) map[int]*redis.Client {
+	clients := make(map[int]*redis.Client, len(dbs))
+
+	for _, db := range dbs {
+		opts := *options
+		opts.DB = db
+		clients[db] = redis.NewClient(&opts)
+	}
+
+	return clients
+}
+
+// TagKey prefixes a sample key with its database, so samples of merged databases can be read back
+func TagKey(db int, key string) string {
+	return strconv.Itoa(db) + ":" + key
+}
+
+// UntagKey splits a sample key tagged by TagKey
+func UntagKey(sample string) (db int, key string) {
+	i := strings.IndexByte(sample, ':')
+
+	if i < 0 {
+		return 0, sample
+	}
+
+	db, _ = strconv.Atoi(sample[:i])
+	key = sample[i+1:]
+	return
+}
+
+// DBCounts returns the key number of each database of a merged node, counted by "db<n>" fields of the node data
+func DBCounts(data map[string]int64) map[int]int64 {
+	counts := make(map[int]int64, 16)
+
+	for name, num := range data {
+		if !strings.HasPrefix(name, "db") || num == 0 {
+			continue
+		}
+
+		if db, e := strconv.Atoi(strings.TrimPrefix(name, "db")); e == nil {
+			counts[db] = num
+		}
+	}
+
+	return counts
+}
+
+// FormatDBs formats the databases of a merged node
+func FormatDBs(data map[string]int64) string {
+	counts := DBCounts(data)
+	dbs := make([]int, 0, len(counts))
+
+	for db := range counts {
+		dbs = append(dbs, db)
+	}
+
+	sort.Ints(dbs)
+	items := make([]string, 0, len(dbs))
+
+	for _, db := range dbs {
+		items = append(items, strconv.Itoa(db))
+	}
+
+	return strings.Join(items, ",")
+}
+
+// ServerVersion returns the redis_version of INFO server
+func ServerVersion(client *redis.Client) (version string, err error) {
+	info, err := client.Info("server").Result()
+
+	if err != nil {
+		return
+	}
+
+	version = ParseInfo(info)["redis_version"]
+	return
+}
+
+// VersionAtLeast checks a version like "7.2.4" is not older than major.minor
+func VersionAtLeast(version string, major, minor int) bool {
+	items := strings.SplitN(version, ".", 3)
+
+	if len(items) < 2 {
+		return false
+	}
+
+	v1, _ := strconv.Atoi(items[0])
+	v2, _ := strconv.Atoi(items[1])
+	return v1 > major || (v1 == major && v2 >= minor)
+}
+
+// NoTouch makes the clients created by the options run CLIENT NO-TOUCH on connect, so their commands don't
+// update the LRU/LFU data of keys, ok is false on servers older than 7.2, which don't support it
+func NoTouch(options *redis.Options) (ok bool, version string, err error) {
+	client := redis.NewClient(options)
+	version, err = ServerVersion(client)
+	client.Close()
+
+	if err != nil || !VersionAtLeast(version, 7, 2) {
+		return
+	}
+
+	onConnect := options.OnConnect
+	options.OnConnect = func(conn *redis.Conn) error {
+		if err := conn.Do("client", "no-touch", "on").Err(); err != nil {
+			return err
+		}
+
+		if onConnect != nil {
+			return onConnect(conn)
+		}
+
+		return nil
+	}
+
+	ok = true
+	return
+}
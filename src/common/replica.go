@@ -0,0 +1,140 @@
+package common
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis"
+	"github.com/marsmay/golib/strings2"
+)
+
+// Replica is a replica of a master from INFO replication
+type Replica struct {
+	Addr   string
+	State  string
+	Offset int64
+	Lag    int64
+}
+
+// Replicas returns the replicas connected to the master, from the slave<n> fields of INFO replication
+func Replicas(client *redis.Client) (replicas []*Replica, offset int64, err error) {
+	info, err := client.Info("replication").Result()
+
+	if err != nil {
+		return
+	}
+
+	fields := ParseInfo(info)
+	offset, _ = strconv.ParseInt(fields["master_repl_offset"], 10, 64)
+
+	for name, value := range fields {
+		if !strings.HasPrefix(name, "slave") || !strings2.IsNum(strings.TrimPrefix(name, "slave")) {
+			continue
+		}
+
+		items := ParseInfoValue(value)
+		replica := &Replica{Addr: net.JoinHostPort(items["ip"], items["port"]), State: items["state"]}
+		replica.Offset, _ = strconv.ParseInt(items["offset"], 10, 64)
+		replica.Lag, _ = strconv.ParseInt(items["lag"], 10, 64)
+		replicas = append(replicas, replica)
+	}
+
+	return
+}
+
+// UseReplica finds an online replica with the least lag for the reads of an analysis, or uses the url itself
+// when it is a replica, master is the client to check the replication lag
+func UseReplica(options *redis.Options) (replica *redis.Options, master *redis.Client, err error) {
+	client := redis.NewClient(options)
+	info, err := client.Info("replication").Result()
+
+	if err != nil {
+		client.Close()
+		return
+	}
+
+	fields := ParseInfo(info)
+	replica = &redis.Options{}
+	*replica = *options
+
+	if fields["role"] == "slave" {
+		client.Close()
+
+		opts := *options
+		opts.Addr = net.JoinHostPort(fields["master_host"], fields["master_port"])
+		master = redis.NewClient(&opts)
+		return
+	}
+
+	replicas, _, err := Replicas(client)
+
+	if err != nil {
+		client.Close()
+		return
+	}
+
+	var best *Replica
+
+	for _, r := range replicas {
+		if r.State == "online" && (best == nil || r.Lag < best.Lag) {
+			best = r
+		}
+	}
+
+	if best == nil {
+		client.Close()
+		err = fmt.Errorf("no online replica of '%s' found in INFO replication", options.Addr)
+		return
+	}
+
+	replica.Addr, master = best.Addr, client
+	return
+}
+
+// ReplicaLag returns the lag in seconds and the bytes the replica is behind the master, read from the INFO of the replica
+// itself, the address the master sees of it may differ by NAT or replica-announce-ip, only the offset is read from the master
+func ReplicaLag(master, replica *redis.Client) (lag, behind int64, err error) {
+	info, err := replica.Info("replication").Result()
+
+	if err != nil {
+		return
+	}
+
+	fields := ParseInfo(info)
+
+	if fields["role"] != "slave" {
+		err = fmt.Errorf("'%s' is not a replica", replica.Options().Addr)
+		return
+	}
+
+	if status := fields["master_link_status"]; status != "up" {
+		err = fmt.Errorf("link of replica '%s' to the master is %s", replica.Options().Addr, status)
+		return
+	}
+
+	lag, _ = strconv.ParseInt(fields["master_last_io_seconds_ago"], 10, 64)
+	offset, _ := strconv.ParseInt(fields["slave_repl_offset"], 10, 64)
+
+	if info, err = master.Info("replication").Result(); err != nil {
+		return
+	}
+
+	masterOffset, _ := strconv.ParseInt(ParseInfo(info)["master_repl_offset"], 10, 64)
+	behind = masterOffset - offset
+	return
+}
+
+// LogReplicaLag prints the replication lag of the replica at the stage of a run
+func LogReplicaLag(master, replica *redis.Client, stage string) {
+	lag, behind, err := ReplicaLag(master, replica)
+
+	if err != nil {
+		log.Printf("Warning: get replication lag failed, %s", err)
+		return
+	}
+
+	log.Printf("replica '%s' lag at %s: %ds, %d bytes behind master '%s'", replica.Options().Addr, stage, lag, behind, master.Options().Addr)
+}
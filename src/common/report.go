@@ -0,0 +1,263 @@
+package common
+
+import (
+	stdcsv "encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/marsmay/golib/csv"
+)
+
+// output to write the report to stdout
+const Stdout = "-"
+
+// output to serve the report by ServeMetrics
+const Metrics = "metrics"
+
+// Reporter writes a report line by line, the first line is the header
+type Reporter interface {
+	WriteLine(line []string) error
+	Close() error
+}
+
+var reportExts = map[string]string{
+	"csv":    "csv",
+	"json":   "json",
+	"ndjson": "ndjson",
+	"md":     "md",
+	"html":   "html",
+	"prom":   "prom",
+}
+
+// NewReporter creates a reporter of format for a report of the tool and the redis instance, writing to a file in the output directory, or stdout
+func NewReporter(format, output, tool, report, instance string) (reporter Reporter, err error) {
+	ext, ok := reportExts[format]
+
+	if !ok {
+		err = fmt.Errorf("unknown report format '%s'", format)
+		return
+	}
+
+	name := fmt.Sprintf("%s-%s-%s", report, instance, time.Now().Format("20060102150405"))
+
+	if format == "csv" && output != Stdout {
+		return NewCsvReporter(path.Join(output, name+"."+ext))
+	}
+
+	var writer io.WriteCloser
+
+	switch {
+	case output == Metrics && format == "prom":
+		writer, err = newMetricsWriter()
+	case output == Metrics:
+		err = fmt.Errorf("output '%s' only supports format 'prom'", Metrics)
+	case format == "prom":
+		// textfile collectors read the file at any time, so it has a stable name and is replaced at once
+		writer, err = openAtomicOutput(output, fmt.Sprintf("%s-%s-%s.%s", tool, report, instance, ext))
+	default:
+		writer, err = openOutput(output, name+"."+ext)
+	}
+
+	if err != nil {
+		return
+	}
+
+	switch format {
+	case "csv":
+		reporter = &StreamCsvReporter{closer: writer, writer: stdcsv.NewWriter(writer)}
+	case "json":
+		reporter = &JsonReporter{writer: writer, lines: make([]map[string]string, 0, 256)}
+	case "ndjson":
+		encoder := json.NewEncoder(writer)
+		encoder.SetEscapeHTML(false)
+		reporter = &NdjsonReporter{writer: writer, encoder: encoder}
+	case "md":
+		reporter = &MarkdownReporter{writer: writer}
+	case "html":
+		reporter = &HtmlReporter{writer: writer, title: fmt.Sprintf("redis-%s %s", tool, name), lines: make([][]string, 0, 256)}
+	case "prom":
+		reporter = &PromReporter{writer: writer, namespace: "redis_" + tool, instance: instance}
+	}
+
+	return
+}
+
+func openOutput(output, fileName string) (writer io.WriteCloser, err error) {
+	if output == Stdout {
+		return nopCloser{os.Stdout}, nil
+	}
+
+	return os.Create(path.Join(output, fileName))
+}
+
+func openAtomicOutput(output, fileName string) (writer io.WriteCloser, err error) {
+	if output == Stdout {
+		return nopCloser{os.Stdout}, nil
+	}
+
+	fileName = path.Join(output, fileName)
+	file, err := os.Create(fileName + ".tmp")
+
+	if err != nil {
+		return
+	}
+
+	writer = &atomicFile{File: file, name: fileName}
+	return
+}
+
+type atomicFile struct {
+	*os.File
+	name string
+}
+
+func (f *atomicFile) Close() (err error) {
+	if err = f.File.Close(); err != nil {
+		return
+	}
+
+	return os.Rename(f.File.Name(), f.name)
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+type CsvReporter struct {
+	writer *csv.Writer
+}
+
+func (r *CsvReporter) WriteLine(line []string) error {
+	return r.writer.WriteLine(line)
+}
+
+func (r *CsvReporter) Close() error {
+	r.writer.Close()
+	return nil
+}
+
+func NewCsvReporter(fileName string) (reporter *CsvReporter, err error) {
+	writer, err := csv.NewWriter(fileName)
+
+	if err != nil {
+		return
+	}
+
+	reporter = &CsvReporter{writer: writer}
+	return
+}
+
+type StreamCsvReporter struct {
+	closer io.Closer
+	writer *stdcsv.Writer
+}
+
+func (r *StreamCsvReporter) WriteLine(line []string) error {
+	return r.writer.Write(line)
+}
+
+func (r *StreamCsvReporter) Close() error {
+	r.writer.Flush()
+
+	if err := r.writer.Error(); err != nil {
+		return err
+	}
+
+	return r.closer.Close()
+}
+
+type JsonReporter struct {
+	writer io.WriteCloser
+	header []string
+	lines  []map[string]string
+}
+
+func (r *JsonReporter) WriteLine(line []string) error {
+	if r.header == nil {
+		r.header = line
+		return nil
+	}
+
+	r.lines = append(r.lines, toObject(r.header, line))
+	return nil
+}
+
+func (r *JsonReporter) Close() (err error) {
+	encoder := json.NewEncoder(r.writer)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+
+	if err = encoder.Encode(r.lines); err != nil {
+		return
+	}
+
+	return r.writer.Close()
+}
+
+type NdjsonReporter struct {
+	writer  io.WriteCloser
+	encoder *json.Encoder
+	header  []string
+}
+
+func (r *NdjsonReporter) WriteLine(line []string) error {
+	if r.header == nil {
+		r.header = line
+		return nil
+	}
+
+	return r.encoder.Encode(toObject(r.header, line))
+}
+
+func (r *NdjsonReporter) Close() error {
+	return r.writer.Close()
+}
+
+type MarkdownReporter struct {
+	writer  io.WriteCloser
+	started bool
+}
+
+func (r *MarkdownReporter) WriteLine(line []string) (err error) {
+	cells := make([]string, 0, len(line))
+
+	for _, cell := range line {
+		cells = append(cells, strings.NewReplacer("|", `\|`, "\n", " ").Replace(cell))
+	}
+
+	if _, err = fmt.Fprintf(r.writer, "| %s |\n", strings.Join(cells, " | ")); err != nil {
+		return
+	}
+
+	if !r.started {
+		r.started = true
+		_, err = fmt.Fprintf(r.writer, "|%s\n", strings.Repeat(" --- |", len(line)))
+	}
+
+	return
+}
+
+func (r *MarkdownReporter) Close() error {
+	return r.writer.Close()
+}
+
+func toObject(header, line []string) map[string]string {
+	object := make(map[string]string, len(header))
+
+	for i, name := range header {
+		if i < len(line) {
+			object[name] = line[i]
+		}
+	}
+
+	return object
+}
@@ -0,0 +1,28 @@
+package common
+
+import (
+	"math"
+)
+
+// z score of the 95% confidence level
+const ConfidenceZ = 1.96
+
+// Estimate scales hit of the sampled keys to the total keys, return the estimate and its variance
+func Estimate(hit, sampled, total int64) (estimate, variance float64) {
+	if sampled <= 0 {
+		return
+	}
+
+	p := float64(hit) / float64(sampled)
+	estimate = p * float64(total)
+	variance = float64(total) * float64(total) * p * (1 - p) / float64(sampled)
+	return
+}
+
+// ConfidenceInterval returns the 95% confidence interval of an estimate
+func ConfidenceInterval(estimate, variance float64) (low, high int64) {
+	margin := ConfidenceZ * math.Sqrt(variance)
+	low = int64(math.Max(0, math.Round(estimate-margin)))
+	high = int64(math.Round(estimate + margin))
+	return
+}
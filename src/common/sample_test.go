@@ -0,0 +1,47 @@
+package common
+
+import (
+	"math"
+	"testing"
+)
+
+func TestEstimate(t *testing.T) {
+	tests := []struct {
+		hit, sampled, total int64
+		estimate, variance  float64
+	}{
+		{10, 100, 1000, 100, 900},
+		{100, 100, 1000, 1000, 0},
+		{0, 100, 1000, 0, 0},
+		{5, 0, 1000, 0, 0},
+		{1, 4, 8, 2, 3},
+	}
+
+	for _, test := range tests {
+		estimate, variance := Estimate(test.hit, test.sampled, test.total)
+
+		if math.Abs(estimate-test.estimate) > 1e-9 || math.Abs(variance-test.variance) > 1e-9 {
+			t.Errorf("estimate of %d/%d of %d is %f, variance %f, wanted %f, %f",
+				test.hit, test.sampled, test.total, estimate, variance, test.estimate, test.variance)
+		}
+	}
+}
+
+func TestConfidenceInterval(t *testing.T) {
+	tests := []struct {
+		estimate, variance float64
+		low, high          int64
+	}{
+		{100, 900, 41, 159},
+		{100, 0, 100, 100},
+		// the low bound is clamped at 0
+		{1, 100, 0, 21},
+	}
+
+	for _, test := range tests {
+		if low, high := ConfidenceInterval(test.estimate, test.variance); low != test.low || high != test.high {
+			t.Errorf("interval of %f, variance %f is [%d, %d], wanted [%d, %d]",
+				test.estimate, test.variance, low, high, test.low, test.high)
+		}
+	}
+}
@@ -35,6 +35,11 @@ func (t *Tree) merge(node *Node) {
 }
 
 func (t *Tree) AddNode(key, kind string, data map[string]int64) {
+	t.AddSample(key, key, kind, data)
+}
+
+// AddSample adds a key like AddNode, but keeps sample instead of the key in the sample keys of the node
+func (t *Tree) AddSample(key, sample, kind string, data map[string]int64) {
 	items := strings.Split(key, t.separator)
 
 	sort.SliceStable(items, func(i, j int) bool {
@@ -73,7 +78,7 @@ func (t *Tree) AddNode(key, kind string, data map[string]int64) {
 	}
 
 	currNode.Num++
-	currNode.AddKey(key, t.keysLen)
+	currNode.AddKey(sample, t.keysLen)
 
 	if t.dataSeter != nil && data != nil {
 		t.dataSeter(currNode, data)
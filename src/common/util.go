@@ -2,6 +2,7 @@ package common
 
 import (
 	"fmt"
+	"os"
 	"strings"
 
 	"github.com/marsmay/golib/math2"
@@ -10,5 +11,5 @@ import (
 func ProgressBar(width int, done, total int64, description string) {
 	percent := math2.Percent[int64, float64](done, total, 2)
 	doneWidth := math2.Min(100, int(percent)) * width / 100
-	fmt.Printf("%6.2f%%|%s%s| %s\r", percent, strings.Repeat("█", doneWidth), strings.Repeat(" ", width-doneWidth), description)
+	fmt.Fprintf(os.Stderr, "%6.2f%%|%s%s| %s\r", percent, strings.Repeat("█", doneWidth), strings.Repeat(" ", width-doneWidth), description)
 }
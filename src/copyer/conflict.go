@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+)
+
+// policies for target keys which already exist
+const (
+	ConflictSkip      = "skip"
+	ConflictOverwrite = "overwrite"
+	ConflictMerge     = "merge"
+	ConflictFail      = "fail"
+)
+
+func validConflict(conflict string) bool {
+	switch conflict {
+	case ConflictSkip, ConflictOverwrite, ConflictMerge, ConflictFail:
+		return true
+	}
+
+	return false
+}
+
+// Summary counts the keys of a copy by result
+type Summary struct {
+	copied      int64
+	skipped     int64
+	overwritten int64
+	merged      int64
+	expired     int64
+	empty       int64
+}
+
+func (s *Summary) add(field *int64) {
+	atomic.AddInt64(field, 1)
+}
+
+// count counts a copied key by how it was written
+func (s *Summary) count(ok, merge, exists bool) {
+	switch {
+	case !ok:
+		s.add(&s.empty)
+	case merge:
+		s.add(&s.merged)
+	case exists:
+		s.add(&s.overwritten)
+	default:
+		s.add(&s.copied)
+	}
+}
+
+// total returns the number of processed keys
+func (s *Summary) total() int64 {
+	return atomic.LoadInt64(&s.copied) + atomic.LoadInt64(&s.overwritten) + atomic.LoadInt64(&s.merged) +
+		atomic.LoadInt64(&s.skipped) + atomic.LoadInt64(&s.expired) + atomic.LoadInt64(&s.empty)
+}
+
+func (s *Summary) Print() {
+	fmt.Fprintf(os.Stderr, "copied: %d, overwritten: %d, merged: %d, skipped: %d, expired: %d, empty or unsupported: %d\n",
+		s.copied, s.overwritten, s.merged, s.skipped, s.expired, s.empty)
+}
+
+// resolve applies the conflict policy to the target key, skip is true when the existing key is kept
+func (c *Copyer) resolve(sourceKey, targetKey string) (exists, skip bool, err error) {
+	n, err := c.targetClient.Exists(targetKey).Result()
+
+	if err != nil || n == 0 {
+		return
+	}
+
+	exists = true
+
+	switch c.conflict {
+	case ConflictSkip:
+		skip = true
+	case ConflictFail:
+		err = fmt.Errorf("target key '%s' exists", targetKey)
+	case ConflictMerge:
+		var sourceKind, targetKind string
+
+		if sourceKind, err = c.sourceClient.Type(sourceKey).Result(); err != nil {
+			return
+		}
+
+		if targetKind, err = c.targetClient.Type(targetKey).Result(); err != nil {
+			return
+		}
+
+		if sourceKind != targetKind && sourceKind != "none" {
+			err = fmt.Errorf("can't merge %s key '%s' into %s key '%s'", sourceKind, sourceKey, targetKind, targetKey)
+		}
+	case ConflictOverwrite:
+		// RESTORE REPLACE and RENAME of a staging key overwrite by themselves
+		if c.dumper == nil && !c.atomic {
+			err = c.targetClient.Del(targetKey).Err()
+		}
+	}
+
+	return
+}
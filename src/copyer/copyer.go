@@ -1,7 +1,6 @@
 package main
 
 import (
-	"fmt"
 	"strings"
 	"time"
 
@@ -14,42 +13,68 @@ const ScanBatchNum = 500
 type Copyer struct {
 	sourceClient *redis.Client
 	targetClient *redis.Client
+	dumper       *Dumper
+	conflict     string
+	summary      *Summary
+	atomic       bool
+	runId        string
+	deadline     bool
+	concurrency  int
+	batchSize    int
+	verification *Verification
+	rules        Rules
+	targets      map[int]*Copyer
+	mover        *Mover
 }
 
-func (c *Copyer) copy(sourceKey, targetKey string) (ok bool, ttl time.Duration, err error) {
-	ttl, err = c.sourceClient.TTL(sourceKey).Result()
+// copy copies a key type by type, collections are copied through a staging key when staged is true
+func (c *Copyer) copy(sourceKey, targetKey string, staged bool) (ok bool, ttl time.Duration, err error) {
+	expiry, exists, err := c.readExpiry(sourceKey)
 
-	if err != nil {
-		return
+	if err == nil && !exists {
+		err = errExpired
 	}
 
-	if ttl < 0 {
-		ttl = 0
+	if err != nil {
+		return
 	}
 
+	ttl = expiry.TTL
 	kind, err := c.sourceClient.Type(sourceKey).Result()
 
 	if err != nil {
 		return
 	}
 
-	switch strings.ToLower(kind) {
+	kind = strings.ToLower(kind)
+
+	if staged && kind != "string" {
+		ok, err = c.copyStaged(kind, sourceKey, targetKey, expiry)
+	} else {
+		ok, err = c.copyValue(kind, sourceKey, targetKey, expiry)
+	}
+
+	return
+}
+
+func (c *Copyer) copyValue(kind, sourceKey, targetKey string, expiry *Expiry) (ok bool, err error) {
+	switch kind {
 	case "string":
-		ok, err = c.copyString(sourceKey, targetKey, ttl)
+		ok, err = c.copyString(sourceKey, targetKey, expiry)
 	case "list":
-		ok, err = c.copyList(sourceKey, targetKey, ttl)
+		ok, err = c.copyList(sourceKey, targetKey, expiry)
 	case "set":
-		ok, err = c.copySet(sourceKey, targetKey, ttl)
+		ok, err = c.copySet(sourceKey, targetKey, expiry)
 	case "zset":
-		ok, err = c.copyZSet(sourceKey, targetKey, ttl)
+		ok, err = c.copyZSet(sourceKey, targetKey, expiry)
 	case "hash":
-		ok, err = c.copyHash(sourceKey, targetKey, ttl)
+		ok, err = c.copyHash(sourceKey, targetKey, expiry)
 	}
 
 	return
 }
 
-func (c *Copyer) copyString(sourceKey, targetKey string, ttl time.Duration) (ok bool, err error) {
+func (c *Copyer) copyString(sourceKey, targetKey string, expiry *Expiry) (ok bool, err error) {
 	value, err := c.sourceClient.Get(sourceKey).Result()
 
 	if err == redis.Nil {
@@ -61,7 +86,12 @@ func (c *Copyer) copyString(sourceKey, targetKey string, ttl time.Duration) (ok
 		return
 	}
 
-	err = c.targetClient.Set(targetKey, value, ttl).Err()
+	var cmd *redis.StatusCmd
+	err = c.write(targetKey, expiry, func(target redis.Cmdable) { cmd = target.Set(targetKey, value, 0) })
+
+	if err == nil {
+		err = cmd.Err()
+	}
 
 	if err != nil {
 		return
@@ -71,7 +101,7 @@ func (c *Copyer) copyString(sourceKey, targetKey string, ttl time.Duration) (ok
 	return
 }
 
-func (c *Copyer) copyList(sourceKey, targetKey string, ttl time.Duration) (ok bool, err error) {
+func (c *Copyer) copyList(sourceKey, targetKey string, expiry *Expiry) (ok bool, err error) {
 	length, err := c.sourceClient.LLen(sourceKey).Result()
 
 	if err != nil || length == 0 {
@@ -100,7 +130,12 @@ func (c *Copyer) copyList(sourceKey, targetKey string, ttl time.Duration) (ok bo
 			params = append(params, value)
 		}
 
-		newlen, err = c.targetClient.RPush(targetKey, params...).Result()
+		var cmd *redis.IntCmd
+		err = c.write(targetKey, expiry, func(target redis.Cmdable) { cmd = target.RPush(targetKey, params...) })
+
+		if err == nil {
+			newlen, err = cmd.Result()
+		}
 
 		if err != nil {
 			return
@@ -108,15 +143,10 @@ func (c *Copyer) copyList(sourceKey, targetKey string, ttl time.Duration) (ok bo
 	}
 
 	ok = newlen > 0
-
-	if ok && ttl > 0 {
-		err = c.targetClient.Expire(targetKey, ttl).Err()
-	}
-
 	return
 }
 
-func (c *Copyer) copySet(sourceKey, targetKey string, ttl time.Duration) (ok bool, err error) {
+func (c *Copyer) copySet(sourceKey, targetKey string, expiry *Expiry) (ok bool, err error) {
 	length, err := c.sourceClient.SCard(sourceKey).Result()
 
 	if err != nil || length == 0 {
@@ -143,7 +173,12 @@ func (c *Copyer) copySet(sourceKey, targetKey string, ttl time.Duration) (ok boo
 				params = append(params, value)
 			}
 
-			n, err = c.targetClient.SAdd(targetKey, params...).Result()
+			var cmd *redis.IntCmd
+			err = c.write(targetKey, expiry, func(target redis.Cmdable) { cmd = target.SAdd(targetKey, params...) })
+
+			if err == nil {
+				n, err = cmd.Result()
+			}
 
 			if err != nil {
 				return
@@ -158,15 +193,10 @@ func (c *Copyer) copySet(sourceKey, targetKey string, ttl time.Duration) (ok boo
 	}
 
 	ok = newlen > 0
-
-	if ok && ttl > 0 {
-		err = c.targetClient.Expire(targetKey, ttl).Err()
-	}
-
 	return
 }
 
-func (c *Copyer) copyZSet(sourceKey, targetKey string, ttl time.Duration) (ok bool, err error) {
+func (c *Copyer) copyZSet(sourceKey, targetKey string, expiry *Expiry) (ok bool, err error) {
 	length, err := c.sourceClient.ZCard(sourceKey).Result()
 
 	if err != nil || length == 0 {
@@ -189,7 +219,12 @@ func (c *Copyer) copyZSet(sourceKey, targetKey string, ttl time.Duration) (ok bo
 			continue
 		}
 
-		n, err = c.targetClient.ZAdd(targetKey, values...).Result()
+		var cmd *redis.IntCmd
+		err = c.write(targetKey, expiry, func(target redis.Cmdable) { cmd = target.ZAdd(targetKey, values...) })
+
+		if err == nil {
+			n, err = cmd.Result()
+		}
 
 		if err != nil {
 			return
@@ -199,15 +234,10 @@ func (c *Copyer) copyZSet(sourceKey, targetKey string, ttl time.Duration) (ok bo
 	}
 
 	ok = newlen > 0
-
-	if ok && ttl > 0 {
-		err = c.targetClient.Expire(targetKey, ttl).Err()
-	}
-
 	return
 }
 
-func (c *Copyer) copyHash(sourceKey, targetKey string, ttl time.Duration) (ok bool, err error) {
+func (c *Copyer) copyHash(sourceKey, targetKey string, expiry *Expiry) (ok bool, err error) {
 	length, err := c.sourceClient.HLen(sourceKey).Result()
 
 	if err != nil || length == 0 {
@@ -234,7 +264,12 @@ func (c *Copyer) copyHash(sourceKey, targetKey string, ttl time.Duration) (ok bo
 				params[values[i]] = values[i+1]
 			}
 
-			err = c.targetClient.HMSet(targetKey, params).Err()
+			var cmd *redis.StatusCmd
+			err = c.write(targetKey, expiry, func(target redis.Cmdable) { cmd = target.HMSet(targetKey, params) })
+
+			if err == nil {
+				err = cmd.Err()
+			}
 
 			if err != nil {
 				return
@@ -249,52 +284,72 @@ func (c *Copyer) copyHash(sourceKey, targetKey string, ttl time.Duration) (ok bo
 	}
 
 	ok = newlen > 0
+	return
+}
+
+// copyKey copies a key by DUMP and RESTORE in dump mode, or type by type, after applying the conflict policy
+func (c *Copyer) copyKey(sourceKey, targetKey string) (ok bool, ttl time.Duration, err error) {
+	exists, skip, err := c.resolve(sourceKey, targetKey)
 
-	if ok && ttl > 0 {
-		err = c.targetClient.Expire(targetKey, ttl).Err()
+	if err != nil {
+		return
 	}
 
-	return
-}
+	if skip {
+		c.summary.add(&c.summary.skipped)
+		return
+	}
 
-func (c *Copyer) Run(sourcePrefix, targetPrefix string) (err error) {
-	var (
-		cursor uint64
-		keys   []string
-	)
+	merge := exists && c.conflict == ConflictMerge
 
-	for {
-		keys, cursor, err = c.sourceClient.Scan(cursor, sourcePrefix+"*", ScanBatchNum).Result()
+	// existing keys are merged type by type, RESTORE always replaces them
+	var inPlace bool
 
-		if err != nil {
-			return
-		}
+	if c.dumper == nil || merge {
+		inPlace = !c.atomic || merge
+		ok, ttl, err = c.copy(sourceKey, targetKey, !inPlace)
+	} else {
+		var fallback bool
+		ok, fallback, ttl, err = c.dump(sourceKey, targetKey)
 
-		if len(keys) > 0 {
-			for _, key := range keys {
-				targetKey := targetPrefix + strings.TrimPrefix(key, sourcePrefix)
-				ok, ttl, e := c.copy(key, targetKey)
+		if err == nil && fallback {
+			c.summary.add(&c.dumper.fallbacks)
 
-				if e != nil {
-					err = e
-					return
-				}
+			// resolve relies on RESTORE REPLACE to overwrite, the type by type copy would write onto the existing key
+			if exists && c.conflict == ConflictOverwrite && !c.atomic {
+				err = c.targetClient.Del(targetKey).Err()
+			}
 
-				if ok {
-					fmt.Printf("%s => %s (%+v)", key, targetKey, ttl)
-				}
+			if err == nil {
+				inPlace = !c.atomic
+				ok, ttl, err = c.copy(sourceKey, targetKey, !inPlace)
 			}
 		}
+	}
 
-		if cursor == 0 {
-			break
+	// a partial copy written in place is dropped, and an overwritten target too, it holds a value the source no longer has,
+	// merged keys keep their items
+	if err == errExpired {
+		err = nil
+
+		if !merge && (inPlace || c.conflict == ConflictOverwrite) {
+			err = c.targetClient.Del(targetKey).Err()
 		}
+
+		c.summary.add(&c.summary.expired)
+		return false, ttl, err
+	}
+
+	if err != nil {
+		return
 	}
 
+	c.summary.count(ok, merge, exists)
+
 	return
 }
 
-func NewCopyer(sourceUrl, targetUrl string) (copyer *Copyer, err error) {
+func NewCopyer(sourceUrl, targetUrl string, dump bool, conflict string, atomic, deadline bool, concurrency, batchSize int) (copyer *Copyer, err error) {
 	sourceOpts, err := redis.ParseURL(sourceUrl)
 
 	if err != nil {
@@ -307,9 +362,29 @@ func NewCopyer(sourceUrl, targetUrl string) (copyer *Copyer, err error) {
 		return
 	}
 
+	// each worker holds a connection of both clients, and one more of the source for WATCH in move mode,
+	// the progress and scan need one more
+	sourceOpts.PoolSize = math2.Max(sourceOpts.PoolSize, 2*concurrency+1)
+	targetOpts.PoolSize = math2.Max(targetOpts.PoolSize, concurrency+1)
+
 	copyer = &Copyer{
 		sourceClient: redis.NewClient(sourceOpts),
 		targetClient: redis.NewClient(targetOpts),
+		conflict:     conflict,
+		summary:      &Summary{},
+		atomic:       atomic,
+		deadline:     deadline,
+		concurrency:  concurrency,
+		batchSize:    batchSize,
+	}
+
+	if atomic {
+		copyer.runId = newRunId()
 	}
+
+	if dump {
+		copyer.dumper, err = newDumper(copyer.sourceClient, copyer.targetClient, deadline)
+	}
+
 	return
 }
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/marsmay/redis-tools/common"
+)
+
+// the latest RDB version each redis version restores
+var rdbVersions = []struct {
+	major, minor int
+	version      uint16
+}{
+	{7, 4, 12},
+	{7, 2, 11},
+	{7, 0, 10},
+	{5, 0, 9},
+	{4, 0, 8},
+	{3, 2, 7},
+	{3, 0, 6},
+	{2, 6, 6},
+}
+
+// Dumper copies keys by DUMP and RESTORE, with the options the target supports
+type Dumper struct {
+	rdbVersion uint16
+	absTTL     bool
+	idle       bool
+	lfu        bool
+	fallbacks  int64
+}
+
+func rdbVersion(version string) uint16 {
+	for _, v := range rdbVersions {
+		if common.VersionAtLeast(version, v.major, v.minor) {
+			return v.version
+		}
+	}
+
+	return 0
+}
+
+// payloadVersion returns the RDB version of a DUMP payload, which ends with 2 bytes of the version and 8 bytes of CRC64
+func payloadVersion(payload string) (version uint16, err error) {
+	if len(payload) < 10 {
+		err = fmt.Errorf("invalid dump payload of %d bytes", len(payload))
+		return
+	}
+
+	footer := []byte(payload[len(payload)-10:])
+	version = binary.LittleEndian.Uint16(footer[:2])
+	return
+}
+
+func newDumper(source, target *redis.Client, deadline bool) (dumper *Dumper, err error) {
+	version, err := common.ServerVersion(target)
+
+	if err != nil {
+		return
+	}
+
+	dumper = &Dumper{
+		rdbVersion: rdbVersion(version),
+		absTTL:     common.VersionAtLeast(version, 5, 0),
+		idle:       common.VersionAtLeast(version, 5, 0),
+	}
+
+	// keep the counter the source maintains, CONFIG may be disabled on managed instances
+	values, e := source.ConfigGet("maxmemory-policy").Result()
+
+	if e == nil && len(values) == 2 {
+		policy, _ := values[1].(string)
+		dumper.lfu = strings.Contains(policy, "lfu")
+	}
+
+	if !dumper.absTTL {
+		log.Printf("Warning: target redis %s doesn't support RESTORE IDLETIME (5.0+), and ABSTTL for -deadline, "+
+			"the deadline is converted to the remaining ttl at RESTORE", version)
+	}
+
+	return
+}
+
+// dump copies a key by DUMP and RESTORE, the access data is read before DUMP, which touches the key,
+// fallback is true when the target can't restore the RDB version of the payload
+func (c *Copyer) dump(sourceKey, targetKey string) (ok, fallback bool, ttl time.Duration, err error) {
+	var idle, freq int64
+
+	if c.dumper.idle {
+		if c.dumper.lfu {
+			freq, err = c.sourceClient.Do("object", "freq", sourceKey).Int64()
+		} else {
+			var d time.Duration
+			d, err = c.sourceClient.ObjectIdleTime(sourceKey).Result()
+			idle = int64(d / time.Second)
+		}
+
+		if err == redis.Nil {
+			err = nil
+			return
+		}
+
+		if err != nil {
+			return
+		}
+	}
+
+	expiry, exists, err := c.readExpiry(sourceKey)
+
+	if err == nil && !exists {
+		err = errExpired
+	}
+
+	if err != nil {
+		return
+	}
+
+	ttl = expiry.TTL
+	payload, err := c.sourceClient.Dump(sourceKey).Result()
+
+	if err == redis.Nil {
+		err = nil
+		return
+	}
+
+	if err != nil {
+		return
+	}
+
+	version, err := payloadVersion(payload)
+
+	if err != nil {
+		return
+	}
+
+	if version > c.dumper.rdbVersion {
+		fallback = true
+		return
+	}
+
+	if expiry.Expired() {
+		err = errExpired
+		return
+	}
+
+	args, err := c.restoreArgs(targetKey, payload, expiry, idle, freq)
+
+	if err != nil {
+		return
+	}
+
+	if err = c.targetClient.Do(args...).Err(); err != nil {
+		return
+	}
+
+	ok = true
+	return
+}
+
+// restoreArgs returns the args of RESTORE, it fails with errExpired when less than a millisecond of the ttl remains,
+// a ttl of 0 would restore the key without expiration
+func (c *Copyer) restoreArgs(targetKey, payload string, expiry *Expiry, idle, freq int64) (args []interface{}, err error) {
+	ttl := int64(c.remain(expiry) / time.Millisecond)
+
+	if expiry.TTL > 0 && ttl < 1 {
+		err = errExpired
+		return
+	}
+
+	args = []interface{}{"restore", targetKey, ttl, payload, "replace"}
+
+	if expiry.TTL > 0 && c.deadline && c.dumper.absTTL {
+		args[2] = expiry.Deadline.UnixNano() / int64(time.Millisecond)
+		args = append(args, "absttl")
+	}
+
+	if c.dumper.idle {
+		if c.dumper.lfu {
+			args = append(args, "freq", freq)
+		} else {
+			args = append(args, "idletime", idle)
+		}
+	}
+
+	return
+}
@@ -0,0 +1,783 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/marsmay/redis-tools/common"
+)
+
+const BarWidth = 64
+
+// the progress is refreshed on the interval
+const ProgressInterval = 500 * time.Millisecond
+
+// Progress shows the processed keys against the matched keys of the scan, with the throughput,
+// and the ETA once the scan is finished and the total is known
+type Progress struct {
+	lock      sync.Mutex
+	start     time.Time
+	matched   int64
+	scanned   bool
+	processed func() int64
+}
+
+func (p *Progress) Match(n int64, scanned bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.matched += n
+	p.scanned = scanned
+}
+
+func (p *Progress) Show() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	done, elapsed := p.processed(), time.Since(p.start).Seconds()
+
+	if elapsed <= 0 || p.matched == 0 {
+		return
+	}
+
+	rate := float64(done) / elapsed
+	description := fmt.Sprintf("%.0f keys/s", rate)
+
+	if !p.scanned {
+		description += ", scanning"
+	} else if rate > 0 && p.matched > done {
+		eta := time.Duration(float64(p.matched-done) / rate * float64(time.Second))
+		description += fmt.Sprintf(", eta %s", eta.Round(time.Second))
+	}
+
+	common.ProgressBar(BarWidth, done, p.matched, description)
+}
+
+// batchKey is a source key of a batch, its target key and the target database of rules
+type batchKey struct {
+	source string
+	target string
+	db     int
+}
+
+// prefixMatch pairs the keys of the prefix with the keys of the same suffix under toPrefix
+func prefixMatch(prefix, toPrefix string) func(key string) *batchKey {
+	return func(key string) *batchKey {
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		return &batchKey{source: key, target: toPrefix + strings.TrimPrefix(key, prefix)}
+	}
+}
+
+// rulesMatch pairs the keys of the prefix with the target keys and databases of the rules
+func (c *Copyer) rulesMatch(prefix string) func(key string) *batchKey {
+	return func(key string) *batchKey {
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		target, db, ok := c.rules.Rewrite(key)
+
+		if !ok {
+			return nil
+		}
+
+		return &batchKey{source: key, target: target, db: db}
+	}
+}
+
+// Run scans the source keys and copies them by the worker pool, batches are copied by pipelines where possible,
+// the keys are rewritten by the rules instead of the target prefix when there are rules
+func (c *Copyer) Run(sourcePrefix, targetPrefix string) (err error) {
+	return c.run(sourcePrefix, targetPrefix, (*Copyer).copyBatch, c.summary.total)
+}
+
+// run walks the source keys with fn on the batches, by the copyers of the target databases when there are rules,
+// processed counts the keys for the progress, or the keys of the finished batches when it's nil
+func (c *Copyer) run(sourcePrefix, targetPrefix string, fn func(c *Copyer, batch []*batchKey) error, processed func() int64) (err error) {
+	pattern := escapePattern(sourcePrefix) + "*"
+
+	if c.rules != nil {
+		err = c.walk(c.sourceClient, pattern, c.rulesMatch(sourcePrefix), c.rulesBatch(fn), processed)
+	} else {
+		err = c.walk(c.sourceClient, pattern, prefixMatch(sourcePrefix, targetPrefix), func(batch []*batchKey) error {
+			return fn(c, batch)
+		}, processed)
+	}
+
+	c.summary.Print()
+
+	if c.dumper != nil && c.dumper.fallbacks > 0 {
+		log.Printf("Warning: %d keys are copied type by type, their RDB version is newer than the target supports (%d)",
+			c.dumper.fallbacks, c.dumper.rdbVersion)
+	}
+
+	return
+}
+
+// walk scans the keys of the pattern on the client, and runs fn by the worker pool on batches of the keys paired by match,
+// keys without a pair are skipped, the first error of fn stops the walk, processed counts the keys for the progress,
+// or the keys of the finished batches when it's nil
+func (c *Copyer) walk(client *redis.Client, pattern string, match func(key string) *batchKey, fn func(batch []*batchKey) error,
+	processed func() int64) (err error) {
+	var (
+		batches  = make(chan []*batchKey, c.concurrency)
+		done     = make(chan struct{})
+		stop     = make(chan struct{})
+		finished int64
+		progress = &Progress{start: time.Now(), processed: processed}
+		wg       sync.WaitGroup
+		once     sync.Once
+		failed   error
+	)
+
+	if progress.processed == nil {
+		progress.processed = func() int64 { return atomic.LoadInt64(&finished) }
+	}
+
+	fail := func(e error) {
+		once.Do(func() {
+			failed = e
+			close(done)
+		})
+	}
+
+	for w := 0; w < c.concurrency; w++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for batch := range batches {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				if e := fn(batch); e != nil {
+					fail(e)
+					return
+				}
+
+				atomic.AddInt64(&finished, int64(len(batch)))
+			}
+		}()
+	}
+
+	go func() {
+		ticker := time.NewTicker(ProgressInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				progress.Show()
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	var (
+		cursor uint64
+		keys   []string
+		batch  = make([]*batchKey, 0, c.batchSize)
+	)
+
+	send := func() bool {
+		select {
+		case batches <- batch:
+			batch = make([]*batchKey, 0, c.batchSize)
+			return true
+		case <-done:
+			return false
+		}
+	}
+
+scan:
+	for {
+		select {
+		case <-done:
+			break scan
+		default:
+		}
+
+		keys, cursor, err = client.Scan(cursor, pattern, int64(c.batchSize)).Result()
+
+		if err != nil {
+			fail(err)
+			break
+		}
+
+		var matched int64
+
+		for _, key := range keys {
+			pair := match(key)
+
+			if pair == nil {
+				continue
+			}
+
+			batch = append(batch, pair)
+			matched++
+
+			if len(batch) == c.batchSize && !send() {
+				break scan
+			}
+		}
+
+		progress.Match(matched, cursor == 0)
+
+		if cursor == 0 {
+			if len(batch) > 0 {
+				send()
+			}
+
+			break
+		}
+	}
+
+	close(batches)
+	wg.Wait()
+	close(stop)
+	progress.Show()
+	fmt.Fprintln(os.Stderr)
+
+	return failed
+}
+
+func (c *Copyer) printKey(key *batchKey, ttl time.Duration) {
+	fmt.Printf("%s => %s (%+v)\n", key.source, key.target, ttl)
+}
+
+// copyBatch copies a batch by DUMP and RESTORE pipelines in dump mode, strings by GET and SET pipelines,
+// small collections by pipelines of their items grouped by type, and the other keys one by one
+func (c *Copyer) copyBatch(batch []*batchKey) (err error) {
+	if c.dumper != nil && c.conflict != ConflictMerge {
+		batch, err = c.restoreBatch(batch)
+	} else {
+		var kinds map[*batchKey]string
+
+		if kinds, err = c.typeBatch(batch); err != nil {
+			return
+		}
+
+		if batch, err = c.copyStrings(batch, kinds); err == nil && c.conflict != ConflictMerge {
+			batch, err = c.copyCollections(batch, kinds)
+		}
+	}
+
+	if err != nil {
+		return
+	}
+
+	for _, key := range batch {
+		ok, ttl, e := c.copyKey(key.source, key.target)
+
+		if e != nil {
+			return e
+		}
+
+		if ok {
+			c.printKey(key, ttl)
+		}
+	}
+
+	return
+}
+
+// dropExpired counts a source key expired during the copy, an existing target is deleted under overwrite,
+// it holds a value the source no longer has
+func (c *Copyer) dropExpired(pipe redis.Pipeliner, key *batchKey, exists bool) {
+	c.summary.add(&c.summary.expired)
+
+	if exists && c.conflict == ConflictOverwrite {
+		pipe.Del(key.target)
+	}
+}
+
+// resolveBatch applies the conflict policy to the target keys of a batch by an EXISTS pipeline,
+// skipped keys are counted and removed, exists holds the keys which already exist
+func (c *Copyer) resolveBatch(batch []*batchKey) (keys []*batchKey, exists map[*batchKey]bool, err error) {
+	cmds := make([]*redis.IntCmd, len(batch))
+
+	_, err = c.targetClient.Pipelined(func(pipe redis.Pipeliner) error {
+		for i, key := range batch {
+			cmds[i] = pipe.Exists(key.target)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return
+	}
+
+	keys, exists = make([]*batchKey, 0, len(batch)), make(map[*batchKey]bool, len(batch))
+
+	for i, key := range batch {
+		if cmds[i].Val() == 0 {
+			keys = append(keys, key)
+			continue
+		}
+
+		switch c.conflict {
+		case ConflictSkip:
+			c.summary.add(&c.summary.skipped)
+			continue
+		case ConflictFail:
+			err = fmt.Errorf("target key '%s' exists", key.target)
+			return
+		}
+
+		keys, exists[key] = append(keys, key), true
+	}
+
+	return
+}
+
+// restoreBatch copies a batch by a pipeline of OBJECT, PTTL and DUMP on the source and a pipeline of RESTORE REPLACE
+// on the target, rest holds the keys with a RDB version newer than the target supports
+func (c *Copyer) restoreBatch(batch []*batchKey) (rest []*batchKey, err error) {
+	keys, exists, err := c.resolveBatch(batch)
+
+	if err != nil || len(keys) == 0 {
+		return
+	}
+
+	var (
+		accesses = make([]*redis.Cmd, len(keys))
+		ttls     = make([]*redis.DurationCmd, len(keys))
+		dumps    = make([]*redis.StringCmd, len(keys))
+		readAt   = time.Now()
+	)
+
+	_, err = c.sourceClient.Pipelined(func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			if c.dumper.idle {
+				if c.dumper.lfu {
+					accesses[i] = pipe.Do("object", "freq", key.source)
+				} else {
+					accesses[i] = pipe.Do("object", "idletime", key.source)
+				}
+			}
+
+			ttls[i] = pipe.PTTL(key.source)
+			dumps[i] = pipe.Dump(key.source)
+		}
+
+		return nil
+	})
+
+	// missing keys fail DUMP with redis.Nil, they are checked one by one
+	if err != nil && err != redis.Nil {
+		return
+	}
+
+	var (
+		restores = make([]*redis.StatusCmd, len(keys))
+		expiries = make([]*Expiry, len(keys))
+	)
+
+	_, err = c.targetClient.Pipelined(func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			ttl, payload := ttls[i].Val(), dumps[i].Val()
+
+			if e := dumps[i].Err(); e != nil && e != redis.Nil {
+				return e
+			}
+
+			if ttls[i].Err() != nil || ttl == -2*time.Millisecond || dumps[i].Err() != nil {
+				c.dropExpired(pipe, key, exists[key])
+				continue
+			}
+
+			if version, e := payloadVersion(payload); e != nil || version > c.dumper.rdbVersion {
+				rest = append(rest, key)
+				continue
+			}
+
+			if ttl < 0 {
+				ttl = 0
+			}
+
+			expiries[i] = &Expiry{TTL: ttl, Deadline: readAt.Add(ttl)}
+
+			if expiries[i].Expired() {
+				c.dropExpired(pipe, key, exists[key])
+				continue
+			}
+
+			var access int64
+
+			if accesses[i] != nil {
+				access, _ = accesses[i].Int64()
+			}
+
+			args, e := c.restoreArgs(key.target, payload, expiries[i], access, access)
+
+			if e == errExpired {
+				c.dropExpired(pipe, key, exists[key])
+				continue
+			}
+
+			restores[i] = redis.NewStatusCmd(args...)
+			pipe.Process(restores[i])
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return
+	}
+
+	for i, key := range keys {
+		if restores[i] == nil {
+			continue
+		}
+
+		c.summary.count(true, false, exists[key])
+		c.printKey(key, expiries[i].TTL)
+	}
+
+	return
+}
+
+// typeBatch reads the types of the source keys of a batch by a pipeline of TYPE
+func (c *Copyer) typeBatch(batch []*batchKey) (kinds map[*batchKey]string, err error) {
+	types := make([]*redis.StatusCmd, len(batch))
+
+	_, err = c.sourceClient.Pipelined(func(pipe redis.Pipeliner) error {
+		for i, key := range batch {
+			types[i] = pipe.Type(key.source)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return
+	}
+
+	kinds = make(map[*batchKey]string, len(batch))
+
+	for i, key := range batch {
+		kinds[key] = types[i].Val()
+	}
+
+	return
+}
+
+// copyStrings copies the strings of a batch by a pipeline of PTTL and GET on the source and a transaction of SET
+// and PEXPIRE on the target, rest holds the keys of other types, the existing keys to merge and the keys changed
+// to another type since their type was read
+func (c *Copyer) copyStrings(batch []*batchKey, kinds map[*batchKey]string) (rest []*batchKey, err error) {
+	strs := make([]*batchKey, 0, len(batch))
+
+	for _, key := range batch {
+		if kinds[key] == "string" {
+			strs = append(strs, key)
+		} else {
+			rest = append(rest, key)
+		}
+	}
+
+	if len(strs) == 0 {
+		return
+	}
+
+	keys, exists, err := c.resolveBatch(strs)
+
+	if err != nil || len(keys) == 0 {
+		return
+	}
+
+	merge := c.conflict == ConflictMerge
+
+	// existing keys are merged one by one with the rest, which fails on a target of another type
+	if merge {
+		news := make([]*batchKey, 0, len(keys))
+
+		for _, key := range keys {
+			if exists[key] {
+				rest = append(rest, key)
+			} else {
+				news = append(news, key)
+			}
+		}
+
+		if keys = news; len(keys) == 0 {
+			return
+		}
+	}
+
+	var (
+		ttls   = make([]*redis.DurationCmd, len(keys))
+		values = make([]*redis.StringCmd, len(keys))
+		readAt = time.Now()
+	)
+
+	_, err = c.sourceClient.Pipelined(func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			ttls[i] = pipe.PTTL(key.source)
+			values[i] = pipe.Get(key.source)
+		}
+
+		return nil
+	})
+
+	// a key changed to another type fails with WRONGTYPE, it's copied one by one with the rest
+	if _, ok := err.(net.Error); ok || err == io.EOF {
+		return
+	}
+
+	var (
+		expiries = make([]*Expiry, len(keys))
+		changed  = make(map[*batchKey]bool)
+	)
+
+	for i, key := range keys {
+		if e := values[i].Err(); e != nil && e != redis.Nil {
+			rest, changed[key] = append(rest, key), true
+		}
+	}
+
+	_, err = c.targetClient.TxPipelined(func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			if changed[key] {
+				continue
+			}
+
+			ttl := ttls[i].Val()
+
+			if ttls[i].Err() != nil || ttl == -2*time.Millisecond || values[i].Err() != nil {
+				c.dropExpired(pipe, key, exists[key])
+				continue
+			}
+
+			if ttl < 0 {
+				ttl = 0
+			}
+
+			expiries[i] = &Expiry{TTL: ttl, Deadline: readAt.Add(ttl)}
+
+			if expiries[i].Expired() {
+				expiries[i] = nil
+				c.dropExpired(pipe, key, exists[key])
+				continue
+			}
+
+			pipe.Set(key.target, values[i].Val(), 0)
+			c.expire(pipe, key.target, expiries[i])
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return
+	}
+
+	for i, key := range keys {
+		if expiries[i] == nil {
+			continue
+		}
+
+		c.summary.count(true, false, exists[key])
+		c.printKey(key, expiries[i].TTL)
+	}
+
+	return
+}
+
+// copyCollections copies the collections of a batch up to ScanBatchNum items by a pipeline of the lengths, a pipeline
+// of PTTL and the items on the source, and a transaction of DEL, the write and PEXPIRE on the target,
+// rest holds the larger collections, the keys of other types and the keys changed to another type since their type was read,
+// which are copied one by one in chunks
+func (c *Copyer) copyCollections(batch []*batchKey, kinds map[*batchKey]string) (rest []*batchKey, err error) {
+	if len(batch) == 0 {
+		return
+	}
+
+	lens := make([]*redis.IntCmd, len(batch))
+
+	_, err = c.sourceClient.Pipelined(func(pipe redis.Pipeliner) error {
+		for i, key := range batch {
+			switch kinds[key] {
+			case "list":
+				lens[i] = pipe.LLen(key.source)
+			case "set":
+				lens[i] = pipe.SCard(key.source)
+			case "zset":
+				lens[i] = pipe.ZCard(key.source)
+			case "hash":
+				lens[i] = pipe.HLen(key.source)
+			}
+		}
+
+		return nil
+	})
+
+	// a key changed to another type fails with WRONGTYPE, it's copied one by one with the rest
+	if _, ok := err.(net.Error); ok || err == io.EOF {
+		return
+	}
+
+	small := make([]*batchKey, 0, len(batch))
+
+	for i, key := range batch {
+		if lens[i] == nil || lens[i].Err() != nil || lens[i].Val() == 0 || lens[i].Val() > ScanBatchNum {
+			rest = append(rest, key)
+		} else {
+			small = append(small, key)
+		}
+	}
+
+	if len(small) == 0 {
+		return
+	}
+
+	keys, exists, err := c.resolveBatch(small)
+
+	if err != nil || len(keys) == 0 {
+		return
+	}
+
+	var (
+		ttls   = make([]*redis.DurationCmd, len(keys))
+		values = make([]redis.Cmder, len(keys))
+		readAt = time.Now()
+	)
+
+	_, err = c.sourceClient.Pipelined(func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			ttls[i] = pipe.PTTL(key.source)
+
+			switch kinds[key] {
+			case "list":
+				values[i] = pipe.LRange(key.source, 0, -1)
+			case "set":
+				values[i] = pipe.SMembers(key.source)
+			case "zset":
+				values[i] = pipe.ZRangeWithScores(key.source, 0, -1)
+			case "hash":
+				values[i] = pipe.HGetAll(key.source)
+			}
+		}
+
+		return nil
+	})
+
+	// a key changed to another type fails with WRONGTYPE, it's copied one by one with the rest
+	if _, ok := err.(net.Error); ok || err == io.EOF {
+		return
+	}
+
+	var (
+		expiries = make([]*Expiry, len(keys))
+		changed  = make(map[*batchKey]bool)
+	)
+
+	for i, key := range keys {
+		if e := values[i].Err(); e != nil && e != redis.Nil {
+			rest, changed[key] = append(rest, key), true
+		}
+	}
+
+	_, err = c.targetClient.TxPipelined(func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			if changed[key] {
+				continue
+			}
+
+			ttl := ttls[i].Val()
+
+			if ttls[i].Err() != nil || ttl == -2*time.Millisecond {
+				c.dropExpired(pipe, key, exists[key])
+				continue
+			}
+
+			if ttl < 0 {
+				ttl = 0
+			}
+
+			expiry := &Expiry{TTL: ttl, Deadline: readAt.Add(ttl)}
+			args := collectionArgs(values[i])
+
+			// the collection was emptied since its length was read, so the key is gone
+			if expiry.Expired() || len(args) == 0 {
+				c.dropExpired(pipe, key, exists[key])
+				continue
+			}
+
+			// skip and fail are resolved, and merge isn't batched, so an existing key is overwritten
+			if exists[key] {
+				pipe.Del(key.target)
+			}
+
+			switch kinds[key] {
+			case "list":
+				pipe.RPush(key.target, args...)
+			case "set":
+				pipe.SAdd(key.target, args...)
+			case "zset":
+				pipe.Do(append([]interface{}{"zadd", key.target}, args...)...)
+			case "hash":
+				pipe.Do(append([]interface{}{"hmset", key.target}, args...)...)
+			}
+
+			c.expire(pipe, key.target, expiry)
+			expiries[i] = expiry
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return
+	}
+
+	for i, key := range keys {
+		if expiries[i] == nil {
+			continue
+		}
+
+		c.summary.count(true, false, exists[key])
+		c.printKey(key, expiries[i].TTL)
+	}
+
+	return
+}
+
+// collectionArgs returns the items of a collection read by LRANGE, SMEMBERS, ZRANGE WITHSCORES or HGETALL,
+// as the args of RPUSH and SADD, or the score and member pairs of ZADD, or the field and value pairs of HMSET
+func collectionArgs(cmd redis.Cmder) (args []interface{}) {
+	switch cmd := cmd.(type) {
+	case *redis.StringSliceCmd:
+		for _, value := range cmd.Val() {
+			args = append(args, value)
+		}
+	case *redis.ZSliceCmd:
+		for _, z := range cmd.Val() {
+			args = append(args, z.Score, z.Member)
+		}
+	case *redis.StringStringMapCmd:
+		for field, value := range cmd.Val() {
+			args = append(args, field, value)
+		}
+	}
+
+	return
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// errExpired stops the copy of a key whose source expired or was deleted while it was copied
+var errExpired = errors.New("source key expired or was deleted during the copy")
+
+// Expiry is the expiration of a source key, read by PTTL
+type Expiry struct {
+	TTL      time.Duration
+	Deadline time.Time
+}
+
+// Expired checks the deadline of the source key has passed, keys without expiration never expire
+func (e *Expiry) Expired() bool {
+	return e.TTL > 0 && !time.Now().Before(e.Deadline)
+}
+
+// readExpiry reads the PTTL of the source key, exists is false when the key is already gone
+func (c *Copyer) readExpiry(key string) (expiry *Expiry, exists bool, err error) {
+	readAt := time.Now()
+	ttl, err := c.sourceClient.PTTL(key).Result()
+
+	if err != nil || ttl == -2*time.Millisecond {
+		return
+	}
+
+	if ttl < 0 {
+		ttl = 0
+	}
+
+	expiry, exists = &Expiry{TTL: ttl, Deadline: readAt.Add(ttl)}, true
+	return
+}
+
+// remain returns the ttl to set on the target, the rest to the source deadline in deadline mode
+func (c *Copyer) remain(expiry *Expiry) time.Duration {
+	if c.deadline && expiry.TTL > 0 {
+		return time.Until(expiry.Deadline)
+	}
+
+	return expiry.TTL
+}
+
+// expire adds the expiration of the source key to a write on the target
+func (c *Copyer) expire(target redis.Cmdable, key string, expiry *Expiry) {
+	if expiry.TTL <= 0 {
+		return
+	}
+
+	if c.deadline {
+		target.PExpireAt(key, expiry.Deadline)
+	} else {
+		target.PExpire(key, expiry.TTL)
+	}
+}
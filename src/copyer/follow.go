@@ -0,0 +1,280 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// keyspace notifications of all key events, K is for the __keyspace@N__ channels, A for all event classes
+const NotifyEvents = "KA"
+
+// errInterrupted stops a follow interrupted during the bulk copy, after notify-keyspace-events is restored
+var errInterrupted = errors.New("interrupted during the bulk copy")
+
+// Follower queues the source keys changed since it subscribed to their keyspace notifications
+type Follower struct {
+	lock    sync.Mutex
+	pending map[string]bool
+	notify  chan struct{}
+	synced  int64
+	deleted int64
+}
+
+func (f *Follower) push(key string) {
+	f.lock.Lock()
+	f.pending[key] = true
+	f.lock.Unlock()
+
+	select {
+	case f.notify <- struct{}{}:
+	default:
+	}
+}
+
+// take returns the queued keys and clears the queue
+func (f *Follower) take() (keys []string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	keys = make([]string, 0, len(f.pending))
+
+	for key := range f.pending {
+		keys = append(keys, key)
+	}
+
+	f.pending = make(map[string]bool)
+	return
+}
+
+func (f *Follower) Print() {
+	fmt.Fprintf(os.Stderr, "followed keys, synced: %d, deleted: %d\n", f.synced, f.deleted)
+}
+
+// escapePattern escapes the glob characters of a key prefix for PSUBSCRIBE
+func escapePattern(prefix string) string {
+	var b strings.Builder
+
+	for _, r := range prefix {
+		if strings.ContainsRune(`*?[]\`, r) {
+			b.WriteByte('\\')
+		}
+
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
+
+// enableNotify adds the keyspace notifications of all key events to notify-keyspace-events of the source,
+// origin is the value to restore, it is empty when nothing is changed
+func (c *Copyer) enableNotify() (origin string, changed bool, err error) {
+	values, err := c.sourceClient.ConfigGet("notify-keyspace-events").Result()
+
+	if err != nil {
+		return
+	}
+
+	if len(values) == 2 {
+		origin, _ = values[1].(string)
+	}
+
+	// A stands for g$lshzxetd, the classes of all events except key misses and new keys
+	if strings.Contains(origin, "K") && (strings.Contains(origin, "A") || strings.IndexFunc("g$lshzxetd", func(r rune) bool {
+		return !strings.ContainsRune(origin, r)
+	}) < 0) {
+		return
+	}
+
+	events := origin
+
+	for _, r := range NotifyEvents {
+		if !strings.ContainsRune(events, r) {
+			events += string(r)
+		}
+	}
+
+	if err = c.sourceClient.ConfigSet("notify-keyspace-events", events).Err(); err != nil {
+		err = fmt.Errorf("set notify-keyspace-events to '%s' failed, set it on the source by hand, %s", events, err)
+		return
+	}
+
+	log.Printf("notify-keyspace-events of the source is changed from '%s' to '%s'", origin, events)
+	changed = true
+	return
+}
+
+// subscribe queues the keys of the prefix from the keyspace notifications, until done is closed
+func (c *Copyer) subscribe(pubsub *redis.PubSub, channel string, follower *Follower, done chan struct{}) {
+	for {
+		msg, err := pubsub.Receive()
+
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		if err != nil {
+			log.Printf("Warning: receive keyspace notifications failed, changes may be lost while reconnecting, "+
+				"check the keys by -verify after cut over, %s", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		if msg, ok := msg.(*redis.Message); ok {
+			follower.push(strings.TrimPrefix(msg.Channel, channel))
+		}
+	}
+}
+
+// syncKey copies a changed source key again, or deletes its target key once it's gone
+func (c *Copyer) syncKey(key *batchKey, follower *Follower) (err error) {
+	n, err := c.sourceClient.Exists(key.source).Result()
+
+	if err != nil {
+		return
+	}
+
+	if n == 0 {
+		if err = c.targetClient.Del(key.target).Err(); err == nil {
+			atomic.AddInt64(&follower.deleted, 1)
+			fmt.Printf("%s => %s (deleted)\n", key.source, key.target)
+		}
+
+		return
+	}
+
+	ok, ttl, err := c.copyKey(key.source, key.target)
+
+	if err != nil {
+		return
+	}
+
+	atomic.AddInt64(&follower.synced, 1)
+
+	if ok {
+		c.printKey(key, ttl)
+	}
+
+	return
+}
+
+// syncKeys syncs the queued keys by the worker pool
+func (c *Copyer) syncKeys(sourcePrefix, targetPrefix string, follower *Follower) (err error) {
+	var (
+		keys   = make(chan *batchKey)
+		wg     sync.WaitGroup
+		once   sync.Once
+		failed error
+	)
+
+	for w := 0; w < c.concurrency; w++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for key := range keys {
+				if e := c.syncKey(key, follower); e != nil {
+					once.Do(func() { failed = e })
+				}
+			}
+		}()
+	}
+
+	for _, key := range follower.take() {
+		keys <- &batchKey{source: key, target: targetPrefix + strings.TrimPrefix(key, sourcePrefix)}
+	}
+
+	close(keys)
+	wg.Wait()
+
+	return failed
+}
+
+// Follow subscribes to the keyspace notifications of the source prefix, runs the bulk copy, then copies the changed
+// keys again until SIGINT or SIGTERM for the cut over, changes during the bulk copy are queued and synced after it,
+// so a batch read before a change never overwrites it
+func (c *Copyer) Follow(sourcePrefix, targetPrefix string) (err error) {
+	// the signals are caught before notify-keyspace-events is changed, so it's restored by Ctrl+C at any time
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(stop)
+
+	origin, changed, err := c.enableNotify()
+
+	if err != nil {
+		return
+	}
+
+	if changed {
+		defer func() {
+			if e := c.sourceClient.ConfigSet("notify-keyspace-events", origin).Err(); e != nil {
+				log.Printf("Warning: restore notify-keyspace-events to '%s' failed, %s", origin, e)
+			}
+		}()
+	}
+
+	var (
+		channel  = fmt.Sprintf("__keyspace@%d__:", c.sourceClient.Options().DB)
+		follower = &Follower{pending: make(map[string]bool), notify: make(chan struct{}, 1)}
+		pubsub   = c.sourceClient.PSubscribe(channel + escapePattern(sourcePrefix) + "*")
+	)
+
+	done := make(chan struct{})
+
+	defer func() {
+		close(done)
+		pubsub.Close()
+	}()
+
+	// wait for the subscription, so no change after the bulk copy starts is missed
+	if _, err = pubsub.Receive(); err != nil {
+		return
+	}
+
+	go c.subscribe(pubsub, channel, follower, done)
+
+	copied := make(chan error, 1)
+
+	go func() {
+		copied <- c.Run(sourcePrefix, targetPrefix)
+	}()
+
+	select {
+	case err = <-copied:
+		if err != nil {
+			return
+		}
+	case <-stop:
+		// the workers of the bulk copy are stopped by the exit
+		return errInterrupted
+	}
+
+	log.Printf("bulk copy is done, following the changes of '%s', press Ctrl+C to stop for the cut over", sourcePrefix)
+
+	for {
+		if err = c.syncKeys(sourcePrefix, targetPrefix, follower); err != nil {
+			return
+		}
+
+		select {
+		case <-follower.notify:
+		case <-stop:
+			// the changes queued before the stop are still synced
+			err = c.syncKeys(sourcePrefix, targetPrefix, follower)
+			follower.Print()
+			return
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"log"
 	"runtime"
+	"time"
 )
 
 var (
@@ -14,6 +15,19 @@ var (
 	sourcePrefix string
 	targetUrl    string
 	targetPrefix string
+	dump         bool
+	conflict     string
+	atomicCopy   bool
+	cleanup      bool
+	deadline     bool
+	concurrency  int
+	batchSize    int
+	verify       bool
+	follow       bool
+	psync        bool
+	rulesFile    string
+	move         bool
+	verification = &Verification{}
 
 	buildTime string
 	gitHash   string
@@ -27,6 +41,22 @@ func init() {
 	flag.StringVar(&sourcePrefix, "sp", "", "")
 	flag.StringVar(&targetUrl, "tu", "redis://127.0.0.1:6379/0", "")
 	flag.StringVar(&targetPrefix, "tp", "", "")
+	flag.BoolVar(&dump, "dump", false, "")
+	flag.StringVar(&conflict, "conflict", ConflictOverwrite, "")
+	flag.BoolVar(&atomicCopy, "atomic", false, "")
+	flag.BoolVar(&cleanup, "cleanup", false, "")
+	flag.BoolVar(&deadline, "deadline", false, "")
+	flag.IntVar(&concurrency, "c", 8, "")
+	flag.IntVar(&batchSize, "b", 100, "")
+	flag.BoolVar(&verify, "verify", false, "")
+	flag.BoolVar(&follow, "follow", false, "")
+	flag.BoolVar(&psync, "psync", false, "")
+	flag.StringVar(&rulesFile, "rules", "", "")
+	flag.BoolVar(&move, "move", false, "")
+	flag.BoolVar(&verification.Repair, "repair", false, "")
+	flag.DurationVar(&verification.Tolerance, "ttl-tolerance", time.Second, "")
+	flag.StringVar(&verification.Format, "f", "csv", "")
+	flag.StringVar(&verification.Output, "o", "./", "")
 
 	flag.Usage = func() {
 		fmt.Printf(usage, gitHash, buildTime)
@@ -37,7 +67,25 @@ func main() {
 	// parse flag
 	flag.Parse()
 
-	if sourcePrefix == "" || targetPrefix == "" {
+	// the target keys are rewritten by the rules, all keys are matched without the source prefix
+	if rulesFile != "" && (targetPrefix != "" || verify || follow || psync) {
+		flag.Usage()
+		return
+	}
+
+	if (rulesFile == "" && (sourcePrefix == "" || targetPrefix == "")) || !validConflict(conflict) || concurrency <= 0 || batchSize <= 0 || verification.Tolerance < 0 {
+		flag.Usage()
+		return
+	}
+
+	// keys are deleted from the source by move, the other modes keep them
+	if move && (verify || follow || psync) {
+		flag.Usage()
+		return
+	}
+
+	// the target follows the source, so existing keys are always overwritten
+	if (follow || psync) && (verify || conflict != ConflictOverwrite || follow == psync) {
 		flag.Usage()
 		return
 	}
@@ -46,10 +94,76 @@ func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
 	// init copyer
-	copyer, err := NewCopyer(sourceUrl, targetUrl)
+	copyer, err := NewCopyer(sourceUrl, targetUrl, dump, conflict, atomicCopy, deadline, concurrency, batchSize)
 
 	if err != nil {
-		log.Fatalf("Fatal Error: invalid redis url '%s' '%s', %s", sourceUrl, targetUrl, err)
+		log.Fatalf("Fatal Error: init copyer failed, redis url '%s' '%s', %s", sourceUrl, targetUrl, err)
+	}
+
+	// load rewriting rules
+	if rulesFile != "" {
+		rules, err := LoadRules(rulesFile, copyer.targetClient.Options().DB)
+
+		if err != nil {
+			log.Fatalf("Fatal Error: load rules '%s' failed, %s", rulesFile, err)
+		}
+
+		copyer.UseRules(rules)
+	}
+
+	// clean up staging keys
+	if cleanup {
+		deleted, err := copyer.Cleanup()
+
+		if err != nil {
+			log.Fatalf("Fatal Error: clean up staging keys failed, %s", err)
+		}
+
+		log.Printf("%d staging keys are deleted", deleted)
+	}
+
+	// do verify
+	if verify {
+		err = copyer.Verify(sourcePrefix, targetPrefix, verification)
+
+		if err != nil {
+			log.Fatalf("Fatal Error: verify '%s' with '%s' failed, %s", sourcePrefix, targetPrefix, err)
+		}
+
+		return
+	}
+
+	// do copy and stream the changes as a replica
+	if psync {
+		err = copyer.Sync(sourcePrefix, targetPrefix)
+
+		if err != nil {
+			log.Fatalf("Fatal Error: sync '%s' to '%s' failed, %s", sourcePrefix, targetPrefix, err)
+		}
+
+		return
+	}
+
+	// do copy and follow the changes
+	if follow {
+		err = copyer.Follow(sourcePrefix, targetPrefix)
+
+		if err != nil {
+			log.Fatalf("Fatal Error: follow '%s' to '%s' failed, %s", sourcePrefix, targetPrefix, err)
+		}
+
+		return
+	}
+
+	// do move
+	if move {
+		err = copyer.Move(sourcePrefix, targetPrefix, &Mover{Tolerance: verification.Tolerance})
+
+		if err != nil {
+			log.Fatalf("Fatal Error: move '%s' to '%s' failed, %s", sourcePrefix, targetPrefix, err)
+		}
+
+		return
 	}
 
 	// do copy
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// errSameKeys stops a move whose target keys are the source keys, which would be deleted after the copy
+var errSameKeys = errors.New("source and target are the same keys")
+
+// Mover counts the source keys of a move by result, kept keys are copied but not deleted, except colliding keys,
+// whose target is already moved to by another source key, or is a source key of the move itself
+type Mover struct {
+	Tolerance  time.Duration
+	lock       sync.Mutex
+	targets    map[string]bool
+	match      func(key string) *batchKey
+	moved      int64
+	changed    int64
+	mismatched int64
+	collided   int64
+}
+
+func (m *Mover) Print() {
+	fmt.Fprintf(os.Stderr, "moved: %d, kept changed during the copy: %d, kept mismatched on the target: %d, kept colliding: %d\n",
+		m.moved, m.changed, m.mismatched, m.collided)
+}
+
+// claim reserves a target key for a source key, it fails when the target is claimed by another source key in this run
+func (m *Mover) claim(db int, key string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	target := strconv.Itoa(db) + ":" + key
+
+	if m.targets[target] {
+		return false
+	}
+
+	m.targets[target] = true
+	return true
+}
+
+// collide checks a source key can be moved to its target, the target of a move in the same database mustn't be
+// a source key of the move, which would be overwritten before it's moved, and the target is claimed by one source key only
+func (c *Copyer) collide(key *batchKey) (collided bool, err error) {
+	source, target := c.sourceClient.Options(), c.targetClient.Options()
+
+	if source.Addr == target.Addr && source.DB == target.DB {
+		if key.source == key.target {
+			err = fmt.Errorf("%w, key '%s'", errSameKeys, key.source)
+			return
+		}
+
+		if c.mover.match(key.target) != nil {
+			log.Printf("Warning: '%s' is kept, its target '%s' is a source key of the move", key.source, key.target)
+			collided = true
+		}
+	}
+
+	if !collided && !c.mover.claim(key.db, key.target) {
+		log.Printf("Warning: '%s' is kept, its target '%s' is moved to by another source key", key.source, key.target)
+		collided = true
+	}
+
+	if collided {
+		atomic.AddInt64(&c.mover.collided, 1)
+	}
+
+	return
+}
+
+// moveKey copies a source key under WATCH, checks the target key matches the source key read before the copy,
+// then deletes the source key by MULTI and EXEC, which fails when the key changed since WATCH
+func (c *Copyer) moveKey(key *batchKey) (err error) {
+	collided, err := c.collide(key)
+
+	if err != nil || collided {
+		return
+	}
+
+	err = c.sourceClient.Watch(func(tx *redis.Tx) (e error) {
+		source, e := readState(tx, key.source)
+
+		if e != nil || source == nil {
+			return
+		}
+
+		ok, ttl, e := c.copyKey(key.source, key.target)
+
+		if e != nil {
+			return
+		}
+
+		if ok {
+			c.printKey(key, ttl)
+		}
+
+		target, e := readState(c.targetClient, key.target)
+
+		if e != nil {
+			return
+		}
+
+		diffs := []string{"missing"}
+
+		if target != nil {
+			diffs = compareState(source, target, c.mover.Tolerance)
+		}
+
+		if len(diffs) > 0 {
+			atomic.AddInt64(&c.mover.mismatched, 1)
+			log.Printf("Warning: '%s' is kept, its target '%s' doesn't match, %s", key.source, key.target, strings.Join(diffs, ", "))
+			return
+		}
+
+		_, e = tx.TxPipelined(func(pipe redis.Pipeliner) error {
+			pipe.Del(key.source)
+			return nil
+		})
+
+		if e == nil {
+			atomic.AddInt64(&c.mover.moved, 1)
+		}
+
+		return
+	}, key.source)
+
+	// the source key changed after WATCH, it is copied again by the next move
+	if err == redis.TxFailedErr {
+		atomic.AddInt64(&c.mover.changed, 1)
+		err = nil
+	}
+
+	return
+}
+
+func (c *Copyer) moveBatch(batch []*batchKey) (err error) {
+	for _, key := range batch {
+		if err = c.moveKey(key); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// Move copies the source keys like Run, and deletes each source key once its target key is confirmed to match,
+// keys changed during the copy, or not matched by the target, are kept on the source
+func (c *Copyer) Move(sourcePrefix, targetPrefix string, m *Mover) (err error) {
+	source, target := c.sourceClient.Options(), c.targetClient.Options()
+
+	if c.rules == nil && source.Addr == target.Addr && source.DB == target.DB && sourcePrefix == targetPrefix {
+		return errSameKeys
+	}
+
+	c.mover, m.targets = m, make(map[string]bool)
+
+	if c.rules != nil {
+		m.match = c.rulesMatch(sourcePrefix)
+	} else {
+		m.match = prefixMatch(sourcePrefix, targetPrefix)
+	}
+
+	for _, t := range c.targets {
+		t.mover = m
+	}
+
+	err = c.run(sourcePrefix, targetPrefix, (*Copyer).moveBatch, nil)
+	m.Print()
+	return
+}
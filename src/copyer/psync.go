@@ -0,0 +1,683 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// the replication offset is acknowledged on the interval, the master drops replicas silent for repl-timeout
+const AckInterval = time.Second
+
+// KeySpec is the key positions of a command from COMMAND, keys of movable commands are found by COMMAND GETKEYS
+type KeySpec struct {
+	first   int
+	last    int
+	step    int
+	movable bool
+}
+
+// Syncer streams the changes of the source by the replication protocol, it loads the RDB of a full resync,
+// then applies the replicated commands on the keys of the prefix
+type Syncer struct {
+	conn     net.Conn
+	reader   *bufio.Reader
+	lock     sync.Mutex
+	offset   int64
+	db       int
+	specs    map[string]*KeySpec
+	restored int64
+	expired  int64
+	applied  int64
+	skipped  int64
+}
+
+func (s *Syncer) Print() {
+	fmt.Fprintf(os.Stderr, "restored: %d, expired: %d, applied commands: %d, skipped commands: %d, offset: %d\n",
+		s.restored, s.expired, s.applied, s.skipped, atomic.LoadInt64(&s.offset))
+}
+
+// send writes a command as a RESP array of bulk strings
+func (s *Syncer) send(args ...string) (err error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	_, err = s.conn.Write([]byte(b.String()))
+	return
+}
+
+// readLine reads a line of a reply, the empty lines the master sends to keep the connection during BGSAVE are skipped
+func (s *Syncer) readLine() (line string, err error) {
+	for line == "" {
+		if line, err = s.reader.ReadString('\n'); err != nil {
+			return
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+	}
+
+	if line[0] == '-' {
+		err = fmt.Errorf("%s", line[1:])
+	}
+
+	return
+}
+
+func (s *Syncer) call(args ...string) (reply string, err error) {
+	if err = s.send(args...); err != nil {
+		return
+	}
+
+	return s.readLine()
+}
+
+func (s *Syncer) ack() error {
+	return s.send("replconf", "ack", strconv.FormatInt(atomic.LoadInt64(&s.offset), 10))
+}
+
+// readCommand reads a replicated command, n is its size in bytes, which the replication offset counts
+func (s *Syncer) readCommand() (args []string, n int64, err error) {
+	line, err := s.reader.ReadString('\n')
+
+	if err != nil {
+		return
+	}
+
+	n += int64(len(line))
+
+	if line[0] != '*' {
+		err = fmt.Errorf("invalid replication stream line '%s'", strings.TrimSpace(line))
+		return
+	}
+
+	count, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+
+	if err != nil {
+		return
+	}
+
+	args = make([]string, count)
+
+	for i := range args {
+		if line, err = s.reader.ReadString('\n'); err != nil {
+			return
+		}
+
+		n += int64(len(line))
+		var size int
+
+		if size, err = strconv.Atoi(strings.TrimSpace(line[1:])); err != nil {
+			return
+		}
+
+		data := make([]byte, size+2)
+
+		if _, err = io.ReadFull(s.reader, data); err != nil {
+			return
+		}
+
+		n += int64(len(data))
+		args[i] = string(data[:size])
+	}
+
+	return
+}
+
+// loadSpecs reads the key positions of the commands and subcommands of the source,
+// COMMAND is parsed by hand, go-redis only knows the 6 fields of redis 3
+func (s *Syncer) loadSpecs(client *redis.Client) (err error) {
+	reply, err := client.Do("command").Result()
+
+	if err != nil {
+		return
+	}
+
+	commands, _ := reply.([]interface{})
+	s.specs = make(map[string]*KeySpec, len(commands))
+
+	var add func(command interface{})
+
+	add = func(command interface{}) {
+		fields, ok := command.([]interface{})
+
+		if !ok || len(fields) < 6 {
+			return
+		}
+
+		name, _ := fields[0].(string)
+		flags, _ := fields[2].([]interface{})
+		spec := &KeySpec{}
+
+		for i, v := range []*int{&spec.first, &spec.last, &spec.step} {
+			n, _ := fields[3+i].(int64)
+			*v = int(n)
+		}
+
+		for _, flag := range flags {
+			if flag == "movablekeys" {
+				spec.movable = true
+			}
+		}
+
+		s.specs[strings.ToLower(name)] = spec
+
+		// the subcommands of redis 7.0 are named like xgroup|create
+		if len(fields) > 9 {
+			subcommands, _ := fields[9].([]interface{})
+
+			for _, subcommand := range subcommands {
+				add(subcommand)
+			}
+		}
+	}
+
+	for _, command := range commands {
+		add(command)
+	}
+
+	return
+}
+
+// keyPositions returns the positions of the keys in the args of a command
+func (s *Syncer) keyPositions(client *redis.Client, name string, args []string) (positions []int, err error) {
+	spec := s.specs[name]
+
+	if len(args) > 1 {
+		if sub, ok := s.specs[name+"|"+strings.ToLower(args[1])]; ok {
+			spec = sub
+		}
+	}
+
+	if spec == nil {
+		err = fmt.Errorf("unknown command '%s'", name)
+		return
+	}
+
+	if spec.movable {
+		params := make([]interface{}, 0, len(args)+2)
+		params = append(params, "command", "getkeys")
+
+		for _, arg := range args {
+			params = append(params, arg)
+		}
+
+		var reply interface{}
+
+		if reply, err = client.Do(params...).Result(); err != nil {
+			return
+		}
+
+		keys, _ := reply.([]interface{})
+
+		// the keys are returned in the order of the args
+		for i, key := range keys {
+			start := 1
+
+			if i > 0 {
+				start = positions[i-1] + 1
+			}
+
+			for j := start; j < len(args); j++ {
+				if args[j] == key {
+					positions = append(positions, j)
+					break
+				}
+			}
+
+			if len(positions) != i+1 {
+				err = fmt.Errorf("key '%v' of command '%s' isn't found", key, name)
+				return
+			}
+		}
+
+		return
+	}
+
+	if spec.first <= 0 || spec.step <= 0 {
+		return
+	}
+
+	last := spec.last
+
+	if last < 0 {
+		last += len(args)
+	}
+
+	for i := spec.first; i <= last && i < len(args); i += spec.step {
+		positions = append(positions, i)
+	}
+
+	return
+}
+
+// rewrite renames the keys of a command to the target prefix, ok is false when the keys aren't all of the prefix
+func (s *Syncer) rewrite(positions []int, args []string, sourcePrefix, targetPrefix string) (ok bool) {
+	for _, i := range positions {
+		if !strings.HasPrefix(args[i], sourcePrefix) {
+			return false
+		}
+	}
+
+	for _, i := range positions {
+		args[i] = targetPrefix + strings.TrimPrefix(args[i], sourcePrefix)
+	}
+
+	return true
+}
+
+// handshake registers as a replica and requests a full resync, it returns the reader of the RDB,
+// and the mark which ends it in diskless replication
+func (c *Copyer) handshake(s *Syncer) (rdb io.Reader, mark string, err error) {
+	opts := c.sourceClient.Options()
+
+	if opts.Password != "" {
+		if _, err = s.call("auth", opts.Password); err != nil {
+			return
+		}
+	}
+
+	if _, err = s.call("ping"); err != nil {
+		return
+	}
+
+	_, port, _ := net.SplitHostPort(s.conn.LocalAddr().String())
+
+	if _, err = s.call("replconf", "listening-port", port); err != nil {
+		return
+	}
+
+	if _, err = s.call("replconf", "capa", "eof", "capa", "psync2"); err != nil {
+		return
+	}
+
+	reply, err := s.call("psync", "?", "-1")
+
+	if err != nil {
+		return
+	}
+
+	fields := strings.Fields(reply)
+
+	if len(fields) != 3 || fields[0] != "+FULLRESYNC" {
+		err = fmt.Errorf("unexpected PSYNC reply '%s'", reply)
+		return
+	}
+
+	if s.offset, err = strconv.ParseInt(fields[2], 10, 64); err != nil {
+		return
+	}
+
+	header, err := s.readLine()
+
+	if err != nil {
+		return
+	}
+
+	if strings.HasPrefix(header, "$EOF:") {
+		return s.reader, header[5:], nil
+	}
+
+	size, err := strconv.ParseInt(strings.TrimPrefix(header, "$"), 10, 64)
+
+	if err != nil {
+		err = fmt.Errorf("invalid RDB header '%s'", header)
+		return
+	}
+
+	return &io.LimitedReader{R: s.reader, N: size}, "", nil
+}
+
+// load restores the keys of the prefix in the RDB by RESTORE pipelines
+func (c *Copyer) load(s *Syncer, rdb io.Reader, mark, sourcePrefix, targetPrefix string) (err error) {
+	reader, err := NewRdbReader(rdb)
+
+	if err != nil {
+		return
+	}
+
+	if reader.version > c.dumper.rdbVersion {
+		err = fmt.Errorf("the target restores RDB version %d, older than %d of the source", c.dumper.rdbVersion, reader.version)
+		return
+	}
+
+	var (
+		db     = c.sourceClient.Options().DB
+		batch  = make([][]interface{}, 0, c.batchSize)
+		object *RdbObject
+	)
+
+	flush := func() (e error) {
+		_, e = c.targetClient.Pipelined(func(pipe redis.Pipeliner) error {
+			for _, args := range batch {
+				pipe.Do(args...)
+			}
+
+			return nil
+		})
+
+		atomic.AddInt64(&s.restored, int64(len(batch)))
+		batch = batch[:0]
+		return
+	}
+
+	for {
+		if object, err = reader.Next(); err != nil {
+			break
+		}
+
+		if object.DB != db || !strings.HasPrefix(object.Key, sourcePrefix) {
+			continue
+		}
+
+		expiry := &Expiry{}
+
+		if object.ExpireAt > 0 {
+			expiry.Deadline = time.Unix(0, object.ExpireAt*int64(time.Millisecond))
+			expiry.TTL = time.Until(expiry.Deadline)
+
+			if expiry.TTL <= 0 {
+				s.expired++
+				continue
+			}
+		}
+
+		targetKey := targetPrefix + strings.TrimPrefix(object.Key, sourcePrefix)
+		args, e := c.restoreArgs(targetKey, object.Payload, expiry, object.Idle, object.Freq)
+
+		if e == errExpired {
+			s.expired++
+			continue
+		}
+
+		batch = append(batch, args)
+		fmt.Printf("%s => %s (%+v)\n", object.Key, targetKey, expiry.TTL)
+
+		if len(batch) == c.batchSize {
+			if err = flush(); err != nil {
+				return
+			}
+		}
+	}
+
+	if err != io.EOF {
+		return
+	}
+
+	if err = flush(); err != nil {
+		return
+	}
+
+	if mark != "" {
+		var data []byte
+
+		if data, err = reader.read(len(mark)); err == nil && string(data) != mark {
+			err = fmt.Errorf("invalid RDB end mark '%s'", data)
+		}
+
+		return
+	}
+
+	_, err = io.Copy(io.Discard, rdb)
+	return
+}
+
+// flushPrefix deletes the target keys of the prefix for FLUSHDB and FLUSHALL of the source
+func (c *Copyer) flushPrefix(targetPrefix string) (err error) {
+	var (
+		cursor uint64
+		keys   []string
+	)
+
+	for {
+		keys, cursor, err = c.targetClient.Scan(cursor, escapePattern(targetPrefix)+"*", ScanBatchNum).Result()
+
+		if err != nil {
+			return
+		}
+
+		if len(keys) > 0 {
+			if err = c.targetClient.Del(keys...).Err(); err != nil {
+				return
+			}
+		}
+
+		if cursor == 0 {
+			return
+		}
+	}
+}
+
+// apply runs a batch of commands on the target, in a transaction for MULTI and EXEC of the source,
+// commands failed on the target are warned, connection errors stop the stream
+func (c *Copyer) apply(s *Syncer, batch [][]interface{}, tx bool) (err error) {
+	if len(batch) == 0 {
+		return
+	}
+
+	fn := func(pipe redis.Pipeliner) error {
+		for _, args := range batch {
+			pipe.Do(args...)
+		}
+
+		return nil
+	}
+
+	var cmds []redis.Cmder
+
+	if tx {
+		cmds, err = c.targetClient.TxPipelined(fn)
+	} else {
+		cmds, err = c.targetClient.Pipelined(fn)
+	}
+
+	if _, ok := err.(net.Error); ok || err == io.EOF {
+		return
+	}
+
+	for _, cmd := range cmds {
+		if e := cmd.Err(); e != nil && e != redis.Nil {
+			log.Printf("Warning: apply '%s' on the target failed, %s", cmd.Name(), e)
+		}
+	}
+
+	atomic.AddInt64(&s.applied, int64(len(batch)))
+	return nil
+}
+
+// stream applies the replicated commands until the connection is closed, commands are batched by pipelines
+// while more of the stream is buffered, and MULTI and EXEC blocks by transactions
+func (c *Copyer) stream(s *Syncer, sourcePrefix, targetPrefix string) (err error) {
+	var (
+		db    = c.sourceClient.Options().DB
+		batch = make([][]interface{}, 0, c.batchSize)
+		multi bool
+		warns = make(map[string]bool)
+	)
+
+	for {
+		var (
+			args []string
+			n    int64
+		)
+
+		if args, n, err = s.readCommand(); err != nil {
+			return
+		}
+
+		name := strings.ToLower(args[0])
+
+		switch name {
+		case "ping":
+		case "replconf":
+			if len(args) > 1 && strings.ToLower(args[1]) == "getack" {
+				err = s.ack()
+			}
+		case "select":
+			s.db, _ = strconv.Atoi(args[1])
+		case "multi":
+			err, multi = c.apply(s, batch, false), true
+			batch = batch[:0]
+		case "exec":
+			err, multi = c.apply(s, batch, true), false
+			batch = batch[:0]
+		case "flushall", "flushdb":
+			if name == "flushdb" && s.db != db {
+				break
+			}
+
+			if err = c.apply(s, batch, multi); err == nil {
+				batch = batch[:0]
+				err = c.flushPrefix(targetPrefix)
+			}
+		case "swapdb":
+			log.Printf("Warning: SWAPDB of the source isn't applied, check the keys by -verify")
+		default:
+			if s.db != db {
+				break
+			}
+
+			var positions []int
+
+			if positions, err = s.keyPositions(c.sourceClient, name, args); err != nil || len(positions) == 0 {
+				break
+			}
+
+			if !s.rewrite(positions, args, sourcePrefix, targetPrefix) {
+				// commands on other keys are skipped silently, mixed ones lose the changes of the prefix
+				for _, i := range positions {
+					if strings.HasPrefix(args[i], sourcePrefix) && !warns[name] {
+						warns[name] = true
+						log.Printf("Warning: '%s' mixes keys inside and outside the prefix, it's skipped, "+
+							"check the keys by -verify", name)
+					}
+				}
+
+				s.skipped++
+				break
+			}
+
+			params := make([]interface{}, len(args))
+
+			for i, arg := range args {
+				params[i] = arg
+			}
+
+			batch = append(batch, params)
+		}
+
+		if err != nil {
+			return
+		}
+
+		atomic.AddInt64(&s.offset, n)
+
+		if !multi && (len(batch) >= c.batchSize || s.reader.Buffered() == 0) {
+			if err = c.apply(s, batch, false); err != nil {
+				return
+			}
+
+			batch = batch[:0]
+		}
+	}
+}
+
+// Sync connects to the source as a replica, restores the keys of the prefix from the RDB of a full resync,
+// then applies the replicated commands on them until SIGINT or SIGTERM for the cut over
+func (c *Copyer) Sync(sourcePrefix, targetPrefix string) (err error) {
+	// the RDB holds the deadlines of keys, and the stream PEXPIREAT
+	c.deadline = true
+
+	if c.dumper == nil {
+		if c.dumper, err = newDumper(c.sourceClient, c.targetClient, true); err != nil {
+			return
+		}
+	}
+
+	s := &Syncer{}
+
+	if err = s.loadSpecs(c.sourceClient); err != nil {
+		return
+	}
+
+	if s.conn, err = c.sourceClient.Options().Dialer(); err != nil {
+		return
+	}
+
+	s.reader = bufio.NewReaderSize(s.conn, 1<<20)
+
+	var (
+		stopped int32
+		done    = make(chan struct{})
+		stop    = make(chan os.Signal, 1)
+	)
+
+	defer func() {
+		close(done)
+		s.conn.Close()
+		s.Print()
+	}()
+
+	rdb, mark, err := c.handshake(s)
+
+	if err != nil {
+		return
+	}
+
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(stop)
+
+	// the offset is acknowledged from the full resync on, the stream is buffered by the master while the RDB loads
+	go func() {
+		ticker := time.NewTicker(AckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if e := s.ack(); e != nil {
+					log.Printf("Warning: acknowledge the replication offset failed, %s", e)
+				}
+			case <-stop:
+				atomic.StoreInt32(&stopped, 1)
+				s.conn.Close()
+				return
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	if err = c.load(s, rdb, mark, sourcePrefix, targetPrefix); err != nil {
+		return
+	}
+
+	log.Printf("RDB is loaded, streaming the changes of '%s' from offset %d, press Ctrl+C to stop for the cut over",
+		sourcePrefix, atomic.LoadInt64(&s.offset))
+
+	err = c.stream(s, sourcePrefix, targetPrefix)
+
+	if atomic.LoadInt32(&stopped) == 1 {
+		err = nil
+	}
+
+	return
+}
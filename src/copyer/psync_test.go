@@ -0,0 +1,107 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// waitFor polls the condition until it holds, or fails the test after the timeout
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(10 * time.Second); !cond(); time.Sleep(50 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+	}
+}
+
+// TestSync copies the keys of a prefix from the RDB of a full resync, then the replicated commands on them
+func TestSync(t *testing.T) {
+	source, sourceUrl, _ := startServer(t)
+	target, targetUrl, _ := startServer(t)
+
+	for _, err := range []error{
+		source.Set("user:1", "a", 0).Err(),
+		source.Set("user:ttl", "a", time.Hour).Err(),
+		source.HMSet("user:2", map[string]interface{}{"a": 1, "b": 2}).Err(),
+		source.RPush("user:3", "a", "b", "c").Err(),
+		source.Set("other:1", "a", 0).Err(),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	copyer, err := NewCopyer(sourceUrl, targetUrl, false, ConflictOverwrite, false, false, 2, 10)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer copyer.sourceClient.Close()
+	defer copyer.targetClient.Close()
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- copyer.Sync("user:", "u:")
+	}()
+
+	value := func(key string) string {
+		v, _ := target.Get(key).Result()
+		return v
+	}
+
+	waitFor(t, "the RDB keys", func() bool {
+		return value("u:1") == "a" && target.Exists("u:2", "u:3", "u:ttl").Val() == 3
+	})
+
+	if ttl := target.TTL("u:ttl").Val(); ttl <= 0 || ttl > time.Hour {
+		t.Errorf("ttl of the restored key is %s", ttl)
+	}
+
+	if fields := target.HGetAll("u:2").Val(); len(fields) != 2 || fields["b"] != "2" {
+		t.Errorf("restored hash is %v", fields)
+	}
+
+	for _, err := range []error{
+		source.Set("user:1", "b", 0).Err(),
+		source.Set("user:4", "a", 0).Err(),
+		source.Del("user:3").Err(),
+		source.Set("other:2", "a", 0).Err(),
+		source.Set("user:end", "a", 0).Err(),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the commands are applied in order, so the last one is enough to wait for
+	waitFor(t, "the replicated commands", func() bool {
+		return value("u:end") == "a"
+	})
+
+	if value("u:1") != "b" || value("u:4") != "a" || target.Exists("u:3").Val() != 0 {
+		t.Errorf("replicated commands are not applied, u:1 '%s', u:4 '%s'", value("u:1"), value("u:4"))
+	}
+
+	if keys := target.Keys("other*").Val(); len(keys) > 0 {
+		t.Errorf("keys out of the prefix are copied, %v", keys)
+	}
+
+	if err = syscall.Kill(os.Getpid(), syscall.SIGINT); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Errorf("sync failed, %s", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("sync is not stopped by SIGINT")
+	}
+}
@@ -0,0 +1,599 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"strconv"
+)
+
+// opcodes of the RDB format, see rdb.h of redis
+const (
+	RdbOpSlotInfo  = 0xF4
+	RdbOpFunction2 = 0xF5
+	RdbOpFunction  = 0xF6
+	RdbOpModuleAux = 0xF7
+	RdbOpIdle      = 0xF8
+	RdbOpFreq      = 0xF9
+	RdbOpAux       = 0xFA
+	RdbOpResizeDB  = 0xFB
+	RdbOpExpireMs  = 0xFC
+	RdbOpExpire    = 0xFD
+	RdbOpSelectDB  = 0xFE
+	RdbOpEOF       = 0xFF
+)
+
+// object types of the RDB format which are delimited, the value is copied as is into the RESTORE payload
+const (
+	RdbTypeString         = 0
+	RdbTypeList           = 1
+	RdbTypeSet            = 2
+	RdbTypeZSet           = 3
+	RdbTypeHash           = 4
+	RdbTypeZSet2          = 5
+	RdbTypeModule2        = 7
+	RdbTypeHashZipmap     = 9
+	RdbTypeListZiplist    = 10
+	RdbTypeSetIntset      = 11
+	RdbTypeZSetZiplist    = 12
+	RdbTypeHashZiplist    = 13
+	RdbTypeListQuicklist  = 14
+	RdbTypeStream         = 15
+	RdbTypeHashListpack   = 16
+	RdbTypeZSetListpack   = 17
+	RdbTypeListQuicklist2 = 18
+	RdbTypeStream2        = 19
+	RdbTypeSetListpack    = 20
+	RdbTypeStream3        = 21
+
+	// hashes with field ttls of redis 7.4, the release candidates saved absolute ttls without the min expire time
+	RdbTypeHashMetadataPreGA   = 22
+	RdbTypeHashListpackExPreGA = 23
+	RdbTypeHashMetadata        = 24
+	RdbTypeHashListpackEx      = 25
+)
+
+// CRC64 Jones of the RDB format and DUMP payloads, reflected, without initial and final xor
+var crc64Table = crc64.MakeTable(0x95ac9329ac4bc9b5)
+
+func crc64Jones(data []byte) uint64 {
+	return ^crc64.Update(^uint64(0), crc64Table, data)
+}
+
+// RdbObject is a key of a RDB, with its value as a RESTORE payload
+type RdbObject struct {
+	DB       int
+	Key      string
+	Payload  string
+	ExpireAt int64
+	Idle     int64
+	Freq     int64
+}
+
+// RdbReader reads the keys of a RDB stream, values are only delimited, not decoded
+type RdbReader struct {
+	r       io.Reader
+	version uint16
+	db      int
+	capture *bytes.Buffer
+}
+
+func NewRdbReader(r io.Reader) (reader *RdbReader, err error) {
+	reader = &RdbReader{r: r}
+	header, err := reader.read(9)
+
+	if err != nil {
+		return
+	}
+
+	if string(header[:5]) != "REDIS" {
+		err = fmt.Errorf("invalid RDB header '%s'", header)
+		return
+	}
+
+	version, err := strconv.Atoi(string(header[5:]))
+
+	if err != nil {
+		err = fmt.Errorf("invalid RDB version '%s'", header[5:])
+		return
+	}
+
+	reader.version = uint16(version)
+	return
+}
+
+// read reads n bytes, which are also written to the payload while a value is delimited
+func (r *RdbReader) read(n int) (data []byte, err error) {
+	data = make([]byte, n)
+
+	if _, err = io.ReadFull(r.r, data); err != nil {
+		return
+	}
+
+	if r.capture != nil {
+		r.capture.Write(data)
+	}
+
+	return
+}
+
+func (r *RdbReader) readByte() (b byte, err error) {
+	data, err := r.read(1)
+
+	if err != nil {
+		return
+	}
+
+	b = data[0]
+	return
+}
+
+// readLength reads a length, encoded is true for the special encodings of strings, the length is the encoding then
+func (r *RdbReader) readLength() (length uint64, encoded bool, err error) {
+	b, err := r.readByte()
+
+	if err != nil {
+		return
+	}
+
+	switch b >> 6 {
+	case 0:
+		length = uint64(b & 0x3F)
+	case 1:
+		var next byte
+
+		if next, err = r.readByte(); err != nil {
+			return
+		}
+
+		length = uint64(b&0x3F)<<8 | uint64(next)
+	case 2:
+		var data []byte
+
+		switch b {
+		case 0x80:
+			if data, err = r.read(4); err == nil {
+				length = uint64(binary.BigEndian.Uint32(data))
+			}
+		case 0x81:
+			if data, err = r.read(8); err == nil {
+				length = binary.BigEndian.Uint64(data)
+			}
+		default:
+			err = fmt.Errorf("invalid RDB length 0x%x", b)
+		}
+	default:
+		length, encoded = uint64(b&0x3F), true
+	}
+
+	return
+}
+
+func (r *RdbReader) readLen() (length uint64, err error) {
+	length, _, err = r.readLength()
+	return
+}
+
+// readString reads a string, integer and LZF encoded strings are decoded only with decode
+func (r *RdbReader) readString(decode bool) (value string, err error) {
+	length, encoded, err := r.readLength()
+
+	if err != nil {
+		return
+	}
+
+	if !encoded {
+		var data []byte
+
+		if data, err = r.read(int(length)); err == nil {
+			value = string(data)
+		}
+
+		return
+	}
+
+	var data []byte
+
+	switch length {
+	case 0, 1, 2:
+		if data, err = r.read(1 << length); err != nil {
+			return
+		}
+
+		var n int64
+
+		switch length {
+		case 0:
+			n = int64(int8(data[0]))
+		case 1:
+			n = int64(int16(binary.LittleEndian.Uint16(data)))
+		default:
+			n = int64(int32(binary.LittleEndian.Uint32(data)))
+		}
+
+		value = strconv.FormatInt(n, 10)
+	case 3:
+		var clen, ulen uint64
+
+		if clen, err = r.readLen(); err != nil {
+			return
+		}
+
+		if ulen, err = r.readLen(); err != nil {
+			return
+		}
+
+		if data, err = r.read(int(clen)); err != nil || !decode {
+			return
+		}
+
+		data, err = lzfDecompress(data, int(ulen))
+		value = string(data)
+	default:
+		err = fmt.Errorf("invalid RDB string encoding %d", length)
+	}
+
+	return
+}
+
+// lzfDecompress decodes the LZF strings of the RDB format
+func lzfDecompress(in []byte, size int) (out []byte, err error) {
+	out = make([]byte, 0, size)
+
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+
+		// literal run
+		if ctrl < 32 {
+			if i+ctrl+1 > len(in) {
+				return nil, fmt.Errorf("invalid LZF literal at %d", i)
+			}
+
+			out = append(out, in[i:i+ctrl+1]...)
+			i += ctrl + 1
+			continue
+		}
+
+		// back reference
+		n := ctrl >> 5
+
+		if n == 7 && i < len(in) {
+			n += int(in[i])
+			i++
+		}
+
+		if i >= len(in) {
+			return nil, fmt.Errorf("invalid LZF reference at %d", i)
+		}
+
+		ref := len(out) - (ctrl&0x1F)<<8 - int(in[i]) - 1
+		i++
+
+		if ref < 0 {
+			return nil, fmt.Errorf("invalid LZF reference at %d", i)
+		}
+
+		for j := 0; j < n+2; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+
+	if len(out) != size {
+		err = fmt.Errorf("invalid LZF length %d, wanted %d", len(out), size)
+	}
+
+	return
+}
+
+func (r *RdbReader) skipStrings(n uint64) (err error) {
+	for i := uint64(0); i < n && err == nil; i++ {
+		_, err = r.readString(false)
+	}
+
+	return
+}
+
+func (r *RdbReader) skipLens(n int) (err error) {
+	for i := 0; i < n && err == nil; i++ {
+		_, err = r.readLen()
+	}
+
+	return
+}
+
+// skipModule skips the opcodes of a module value or aux data until the EOF opcode
+func (r *RdbReader) skipModule() (err error) {
+	for {
+		var opcode uint64
+
+		if opcode, err = r.readLen(); err != nil {
+			return
+		}
+
+		switch opcode {
+		case 0:
+			return
+		case 1, 2:
+			_, err = r.readLen()
+		case 3:
+			_, err = r.read(4)
+		case 4:
+			_, err = r.read(8)
+		case 5:
+			_, err = r.readString(false)
+		default:
+			err = fmt.Errorf("invalid RDB module opcode %d", opcode)
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// skipValue delimits a value of the type, by the lengths of its items
+func (r *RdbReader) skipValue(kind byte) (err error) {
+	switch kind {
+	case RdbTypeString, RdbTypeHashZipmap, RdbTypeListZiplist, RdbTypeSetIntset, RdbTypeZSetZiplist,
+		RdbTypeHashZiplist, RdbTypeHashListpack, RdbTypeZSetListpack, RdbTypeSetListpack, RdbTypeHashListpackExPreGA:
+		_, err = r.readString(false)
+		return
+	case RdbTypeHashListpackEx:
+		// the min expire time of the fields, then the listpack of fields, values and ttls
+		if _, err = r.read(8); err == nil {
+			_, err = r.readString(false)
+		}
+
+		return
+	case RdbTypeModule2:
+		if _, err = r.readLen(); err == nil {
+			err = r.skipModule()
+		}
+
+		return
+	case RdbTypeStream, RdbTypeStream2, RdbTypeStream3:
+		return r.skipStream(kind)
+	case RdbTypeHashMetadata:
+		// the min expire time of the fields, which the ttls are relative to
+		if _, err = r.read(8); err != nil {
+			return
+		}
+	}
+
+	n, err := r.readLen()
+
+	if err != nil {
+		return
+	}
+
+	for i := uint64(0); i < n && err == nil; i++ {
+		switch kind {
+		case RdbTypeList, RdbTypeSet, RdbTypeListQuicklist:
+			_, err = r.readString(false)
+		case RdbTypeHash:
+			err = r.skipStrings(2)
+		case RdbTypeHashMetadataPreGA, RdbTypeHashMetadata:
+			// the ttl, the field and the value
+			if _, err = r.readLen(); err == nil {
+				err = r.skipStrings(2)
+			}
+		case RdbTypeZSet:
+			if _, err = r.readString(false); err == nil {
+				err = r.skipDouble()
+			}
+		case RdbTypeZSet2:
+			if _, err = r.readString(false); err == nil {
+				_, err = r.read(8)
+			}
+		case RdbTypeListQuicklist2:
+			if _, err = r.readLen(); err == nil {
+				_, err = r.readString(false)
+			}
+		default:
+			err = fmt.Errorf("unsupported RDB object type %d", kind)
+		}
+	}
+
+	return
+}
+
+// skipDouble skips a score of the old zset type, a length byte with the special values nan, inf and -inf
+func (r *RdbReader) skipDouble() (err error) {
+	n, err := r.readByte()
+
+	if err == nil && n < 253 {
+		_, err = r.read(int(n))
+	}
+
+	return
+}
+
+func (r *RdbReader) skipStream(kind byte) (err error) {
+	n, err := r.readLen()
+
+	if err != nil {
+		return
+	}
+
+	// listpacks by their master ids, then the length and the last id
+	if err = r.skipStrings(2 * n); err != nil {
+		return
+	}
+
+	if err = r.skipLens(3); err != nil {
+		return
+	}
+
+	// the first id, the max deleted id and the entries added
+	if kind >= RdbTypeStream2 {
+		if err = r.skipLens(5); err != nil {
+			return
+		}
+	}
+
+	groups, err := r.readLen()
+
+	for i := uint64(0); i < groups && err == nil; i++ {
+		err = r.skipGroup(kind)
+	}
+
+	return
+}
+
+func (r *RdbReader) skipGroup(kind byte) (err error) {
+	// the name, the last id and the entries read
+	if _, err = r.readString(false); err != nil {
+		return
+	}
+
+	lens := 2
+
+	if kind >= RdbTypeStream2 {
+		lens++
+	}
+
+	if err = r.skipLens(lens); err != nil {
+		return
+	}
+
+	// the pending entries by the raw id, the delivery time and the delivery count
+	pending, err := r.readLen()
+
+	for i := uint64(0); i < pending && err == nil; i++ {
+		if _, err = r.read(24); err == nil {
+			_, err = r.readLen()
+		}
+	}
+
+	if err != nil {
+		return
+	}
+
+	consumers, err := r.readLen()
+
+	for i := uint64(0); i < consumers && err == nil; i++ {
+		// the name, the seen time and the active time
+		if _, err = r.readString(false); err != nil {
+			return
+		}
+
+		size := 8
+
+		if kind >= RdbTypeStream3 {
+			size += 8
+		}
+
+		if _, err = r.read(size); err != nil {
+			return
+		}
+
+		// the raw ids of the consumer pending entries
+		if pending, err = r.readLen(); err == nil {
+			_, err = r.read(int(16 * pending))
+		}
+	}
+
+	return
+}
+
+// Next reads the next key, it returns io.EOF at the end of the RDB, after its checksum
+func (r *RdbReader) Next() (object *RdbObject, err error) {
+	object = &RdbObject{}
+
+	for {
+		var opcode byte
+
+		if opcode, err = r.readByte(); err != nil {
+			return
+		}
+
+		var data []byte
+
+		switch opcode {
+		case RdbOpEOF:
+			if r.version >= 5 {
+				_, err = r.read(8)
+			}
+
+			if err == nil {
+				err = io.EOF
+			}
+
+			return
+		case RdbOpSelectDB:
+			var db uint64
+			db, err = r.readLen()
+			r.db = int(db)
+		case RdbOpResizeDB:
+			err = r.skipLens(2)
+		case RdbOpSlotInfo:
+			err = r.skipLens(3)
+		case RdbOpAux:
+			err = r.skipStrings(2)
+		case RdbOpFunction2:
+			_, err = r.readString(false)
+		case RdbOpFunction:
+			err = fmt.Errorf("unsupported RDB functions of redis 7.0 release candidates")
+		case RdbOpModuleAux:
+			// the module id, the when opcode and the when
+			if err = r.skipLens(3); err == nil {
+				err = r.skipModule()
+			}
+		case RdbOpExpireMs:
+			if data, err = r.read(8); err == nil {
+				object.ExpireAt = int64(binary.LittleEndian.Uint64(data))
+			}
+		case RdbOpExpire:
+			if data, err = r.read(4); err == nil {
+				object.ExpireAt = int64(binary.LittleEndian.Uint32(data)) * 1000
+			}
+		case RdbOpFreq:
+			var freq byte
+			freq, err = r.readByte()
+			object.Freq = int64(freq)
+		case RdbOpIdle:
+			var idle uint64
+			idle, err = r.readLen()
+			object.Idle = int64(idle)
+		default:
+			return object, r.readObject(object, opcode)
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// readObject reads the key and delimits the value of the type, the payload is the type, the value,
+// the RDB version and the CRC64 of them, as DUMP makes it
+func (r *RdbReader) readObject(object *RdbObject, kind byte) (err error) {
+	object.DB = r.db
+
+	if object.Key, err = r.readString(true); err != nil {
+		return
+	}
+
+	r.capture = bytes.NewBuffer([]byte{kind})
+	err = r.skipValue(kind)
+	payload := r.capture
+	r.capture = nil
+
+	if err != nil {
+		return
+	}
+
+	footer := make([]byte, 2)
+	binary.LittleEndian.PutUint16(footer, r.version)
+	payload.Write(footer)
+
+	checksum := make([]byte, 8)
+	binary.LittleEndian.PutUint64(checksum, crc64Jones(payload.Bytes()))
+	payload.Write(checksum)
+
+	object.Payload = payload.String()
+	return
+}
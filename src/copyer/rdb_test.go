@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// startServer runs a redis-server on a free port for the test, the test is skipped without redis-server on PATH
+func startServer(t *testing.T, args ...string) (client *redis.Client, url, dir string) {
+	t.Helper()
+	path, err := exec.LookPath("redis-server")
+
+	if err != nil {
+		t.Skip("redis-server is not found on PATH")
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	port := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+	listener.Close()
+
+	dir = t.TempDir()
+	args = append([]string{"--port", port, "--bind", "127.0.0.1", "--dir", dir, "--save", "", "--appendonly", "no"}, args...)
+	cmd := exec.Command(path, args...)
+
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	url = "redis://127.0.0.1:" + port + "/0"
+	client = redis.NewClient(&redis.Options{Addr: "127.0.0.1:" + port})
+
+	t.Cleanup(func() {
+		client.Close()
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+		if err = client.Ping().Err(); err == nil {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("redis-server on port %s is not ready, %s", port, err)
+		}
+	}
+}
+
+// the example of DUMP in the redis docs, the string 10 saved by RDB version 9
+const dumpExample = "\x00\xc0\n\t\x00\xbem\x06\x89Z(\x00\n"
+
+func TestCrc64Jones(t *testing.T) {
+	if sum := crc64Jones([]byte("123456789")); sum != 0xe9c6d914c4b8d9ca {
+		t.Errorf("crc64 of the check string is %x", sum)
+	}
+}
+
+func TestLzfDecompress(t *testing.T) {
+	// a literal run of abc, then a back reference of 3 bytes at the offset 3
+	out, err := lzfDecompress([]byte{0x02, 'a', 'b', 'c', 0x20, 0x02}, 6)
+
+	if err != nil || string(out) != "abcabc" {
+		t.Errorf("decompressed '%s', %v", out, err)
+	}
+
+	if _, err = lzfDecompress([]byte{0x20, 0x05}, 2); err == nil {
+		t.Error("a reference before the output is accepted")
+	}
+}
+
+func TestRdbReaderExample(t *testing.T) {
+	var rdb bytes.Buffer
+	rdb.WriteString("REDIS0009")
+	rdb.Write([]byte{RdbOpAux, 9})
+	rdb.WriteString("redis-ver")
+	rdb.Write([]byte{5})
+	rdb.WriteString("5.0.7")
+	rdb.Write([]byte{RdbOpSelectDB, 2, RdbOpResizeDB, 1, 1})
+	rdb.Write([]byte{RdbOpExpireMs, 0x10, 0x27, 0, 0, 0, 0, 0, 0})
+	rdb.Write([]byte{RdbTypeString, 3})
+	rdb.WriteString("key")
+	rdb.Write([]byte{0xc0, 10, RdbOpEOF})
+	rdb.Write(make([]byte, 8))
+
+	reader, err := NewRdbReader(&rdb)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	object, err := reader.Next()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if object.DB != 2 || object.Key != "key" || object.ExpireAt != 10000 || object.Payload != dumpExample {
+		t.Errorf("read %+v, wanted the payload %q", object, dumpExample)
+	}
+
+	if _, err = reader.Next(); err != io.EOF {
+		t.Errorf("read %v at the end, wanted EOF", err)
+	}
+}
+
+// TestRdbReaderDump compares the payloads of a saved RDB with DUMP of the same keys, for each encoding
+func TestRdbReaderDump(t *testing.T) {
+	client, _, dir := startServer(t, "--list-max-ziplist-size", "4")
+	long := strings.Repeat("redis-copyer ", 100)
+	keys := map[string]bool{}
+
+	set := func(key string, err error) {
+		t.Helper()
+
+		if err != nil {
+			t.Fatalf("write '%s' failed, %s", key, err)
+		}
+
+		keys[key] = true
+	}
+
+	set("string:raw", client.Set("string:raw", "value", 0).Err())
+	set("string:int", client.Set("string:int", "12345", 0).Err())
+	set("string:lzf", client.Set("string:lzf", long, 0).Err())
+	set("string:ttl", client.Set("string:ttl", "value", time.Hour).Err())
+	set("key:lzf:"+long, client.Set("key:lzf:"+long, "value", 0).Err())
+	set("list:small", client.RPush("list:small", "a", "b", "c").Err())
+	set("set:intset", client.SAdd("set:intset", 1, 2, 3).Err())
+	set("set:small", client.SAdd("set:small", "a", "b", "c").Err())
+	set("hash:small", client.HMSet("hash:small", map[string]interface{}{"a": 1, "b": "x"}).Err())
+	set("zset:small", client.ZAdd("zset:small", redis.Z{Score: 1, Member: "a"}, redis.Z{Score: 2.5, Member: "b"}).Err())
+
+	fields := make(map[string]interface{}, 200)
+	members := make([]redis.Z, 0, 200)
+	items := make([]interface{}, 0, 600)
+
+	for i := 0; i < 200; i++ {
+		fields[fmt.Sprintf("field:%d", i)] = i
+		members = append(members, redis.Z{Score: float64(i) / 3, Member: fmt.Sprintf("member:%d", i)})
+	}
+
+	for i := 0; i < 600; i++ {
+		items = append(items, fmt.Sprintf("item:%d", i))
+	}
+
+	set("list:quicklist", client.RPush("list:quicklist", items[:20]...).Err())
+	set("set:large", client.SAdd("set:large", items...).Err())
+	set("hash:large", client.HMSet("hash:large", fields).Err())
+	set("zset:large", client.ZAdd("zset:large", members...).Err())
+
+	for i := 0; i < 10; i++ {
+		set("stream", client.XAdd(&redis.XAddArgs{Stream: "stream", Values: map[string]interface{}{"n": i}}).Err())
+	}
+
+	set("stream", client.XGroupCreate("stream", "group", "0").Err())
+	set("stream", client.XReadGroup(&redis.XReadGroupArgs{Group: "group", Consumer: "consumer", Streams: []string{"stream", ">"}, Count: 3}).Err())
+
+	// hashes with field ttls of redis 7.4+
+	for _, key := range []string{"hash:ttl:small", "hash:ttl:large"} {
+		if key == "hash:ttl:small" {
+			set(key, client.HMSet(key, map[string]interface{}{"a": 1, "b": 2}).Err())
+		} else {
+			set(key, client.HMSet(key, fields).Err())
+		}
+
+		if err := client.Do("hexpire", key, 3600, "fields", 1, "a").Err(); err != nil {
+			t.Logf("field ttls are not supported, %s", err)
+		}
+	}
+
+	if err := client.Save().Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(filepath.Join(dir, "dump.rdb"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer file.Close()
+	reader, err := NewRdbReader(file)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		object, err := reader.Next()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			t.Fatalf("read RDB failed, %s", err)
+		}
+
+		dump, err := client.Dump(object.Key).Result()
+
+		if err != nil {
+			t.Fatalf("dump '%s' failed, %s", object.Key, err)
+		}
+
+		if object.Payload != dump {
+			t.Errorf("payload of '%.20s' type %d differs from DUMP", object.Key, object.Payload[0])
+		}
+
+		if (object.ExpireAt > 0) != (object.Key == "string:ttl") {
+			t.Errorf("'%.20s' expires at %d", object.Key, object.ExpireAt)
+		}
+
+		delete(keys, object.Key)
+	}
+
+	for key := range keys {
+		t.Errorf("'%.20s' is not read", key)
+	}
+}
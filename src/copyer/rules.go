@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis"
+)
+
+// kinds of rewriting rules
+const (
+	RulePrefix    = "prefix"
+	RuleRegex     = "regex"
+	RuleDrop      = "drop"
+	RuleDropRegex = "drop-regex"
+)
+
+// Rule rewrites the source keys it matches to the target keys, in the target database
+type Rule struct {
+	kind    string
+	prefix  string
+	pattern *regexp.Regexp
+	replace string
+	db      int
+}
+
+// Rules are applied in the order of the file, the first matched rule wins, keys matched by no rule aren't copied
+type Rules []*Rule
+
+// LoadRules reads a rules file, a rule per line, comments start with #, the db is the db of the target url when omitted:
+//
+//	prefix <source prefix> <target prefix> [db]
+//	regex <pattern> <template> [db]
+//	drop <source prefix>
+//	drop-regex <pattern>
+func LoadRules(fileName string, db int) (rules Rules, err error) {
+	file, err := os.Open(fileName)
+
+	if err != nil {
+		return
+	}
+
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		var rule *Rule
+
+		if rule, err = parseRule(fields, db); err != nil {
+			err = fmt.Errorf("invalid rule at line %d, %s", line, err)
+			return
+		}
+
+		rules = append(rules, rule)
+	}
+
+	if err = scanner.Err(); err != nil {
+		return
+	}
+
+	if len(rules) == 0 {
+		err = fmt.Errorf("no rule in '%s'", fileName)
+	}
+
+	return
+}
+
+func parseRule(fields []string, db int) (rule *Rule, err error) {
+	rule = &Rule{kind: fields[0], db: db}
+
+	// drop rules have no target key and database
+	args, max := 3, 4
+
+	if rule.kind == RuleDrop || rule.kind == RuleDropRegex {
+		args, max = 2, 2
+	}
+
+	if len(fields) < args || len(fields) > max {
+		err = fmt.Errorf("wrong number of fields %d", len(fields))
+		return
+	}
+
+	switch rule.kind {
+	case RulePrefix, RuleDrop:
+		rule.prefix = fields[1]
+	case RuleRegex, RuleDropRegex:
+		if rule.pattern, err = regexp.Compile(fields[1]); err != nil {
+			return
+		}
+	default:
+		err = fmt.Errorf("unknown rule '%s'", rule.kind)
+		return
+	}
+
+	if args == 3 {
+		rule.replace = fields[2]
+	}
+
+	if len(fields) > args {
+		if rule.db, err = strconv.Atoi(fields[args]); err != nil || rule.db < 0 {
+			err = fmt.Errorf("invalid db '%s'", fields[args])
+		}
+	}
+
+	return
+}
+
+// Rewrite returns the target key and database of a source key, ok is false when the key is dropped or matched by no rule
+func (rules Rules) Rewrite(key string) (target string, db int, ok bool) {
+	for _, rule := range rules {
+		switch rule.kind {
+		case RulePrefix, RuleDrop:
+			if !strings.HasPrefix(key, rule.prefix) {
+				continue
+			}
+
+			if rule.kind == RulePrefix {
+				target = rule.replace + strings.TrimPrefix(key, rule.prefix)
+			}
+		case RuleRegex, RuleDropRegex:
+			match := rule.pattern.FindStringSubmatchIndex(key)
+
+			if match == nil {
+				continue
+			}
+
+			// the target is the template expanded by the capture groups, like u:$1:v2 or u:${1}v2
+			if rule.kind == RuleRegex {
+				target = string(rule.pattern.ExpandString(nil, rule.replace, key, match))
+			}
+		}
+
+		return target, rule.db, target != ""
+	}
+
+	return
+}
+
+// dbs returns the target databases of the rules
+func (rules Rules) dbs() (dbs []int) {
+	seen := make(map[int]bool)
+
+	for _, rule := range rules {
+		if !seen[rule.db] {
+			seen[rule.db] = true
+			dbs = append(dbs, rule.db)
+		}
+	}
+
+	return
+}
+
+// UseRules rewrites the keys by the rules instead of the target prefix, with a copyer for each target database,
+// which shares the source client and the summary
+func (c *Copyer) UseRules(rules Rules) {
+	c.rules, c.targets = rules, make(map[int]*Copyer)
+	opts := c.targetClient.Options()
+
+	for _, db := range rules.dbs() {
+		if db == opts.DB {
+			c.targets[db] = c
+			continue
+		}
+
+		dbOpts := *opts
+		dbOpts.DB = db
+
+		target := *c
+		target.targetClient = redis.NewClient(&dbOpts)
+		c.targets[db] = &target
+	}
+}
+
+// rulesBatch runs fn on the keys of a batch by the copyers of their target databases
+func (c *Copyer) rulesBatch(fn func(c *Copyer, batch []*batchKey) error) func(batch []*batchKey) error {
+	return func(batch []*batchKey) (err error) {
+		dbBatches := make(map[int][]*batchKey)
+
+		for _, key := range batch {
+			dbBatches[key.db] = append(dbBatches[key.db], key)
+		}
+
+		for db, dbBatch := range dbBatches {
+			if err = fn(c.targets[db], dbBatch); err != nil {
+				return
+			}
+		}
+
+		return
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		line string
+		kind string
+		db   int
+		err  bool
+	}{
+		{"prefix user: u:", RulePrefix, 0, false},
+		{"prefix user: u: 2", RulePrefix, 2, false},
+		{"regex ^user:(\\d+)$ u:$1 3", RuleRegex, 3, false},
+		{"drop tmp:", RuleDrop, 0, false},
+		{"drop-regex ^tmp:\\d+$", RuleDropRegex, 0, false},
+		{"prefix user:", "", 0, true},
+		{"prefix user: u: 2 3", "", 0, true},
+		{"prefix user: u: -1", "", 0, true},
+		{"prefix user: u: x", "", 0, true},
+		{"regex ^user:(\\d+ u:$1", "", 0, true},
+		{"drop tmp: 2", "", 0, true},
+		{"drop-regex", "", 0, true},
+		{"rename user: u:", "", 0, true},
+	}
+
+	for _, test := range tests {
+		rule, err := parseRule(strings.Fields(test.line), 0)
+
+		if test.err {
+			if err == nil {
+				t.Errorf("'%s' is parsed, wanted an error", test.line)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("parse '%s' failed, %s", test.line, err)
+			continue
+		}
+
+		if rule.kind != test.kind || rule.db != test.db {
+			t.Errorf("'%s' is parsed as %s in db %d, wanted %s in db %d", test.line, rule.kind, rule.db, test.kind, test.db)
+		}
+	}
+}
+
+func TestRulesRewrite(t *testing.T) {
+	lines := []string{
+		"drop user:tmp:",
+		"drop-regex ^user:\\d+:lock$",
+		"regex ^user:(\\d+):v1$ u:$1:v2 2",
+		"regex ^user:(\\d+):name$ u:${1}name",
+		"prefix user: u:",
+		"prefix user:vip: vip: 3",
+		"regex ^order:(\\d+)$ $2",
+	}
+
+	rules := make(Rules, 0, len(lines))
+
+	for _, line := range lines {
+		rule, err := parseRule(strings.Fields(line), 1)
+
+		if err != nil {
+			t.Fatalf("parse '%s' failed, %s", line, err)
+		}
+
+		rules = append(rules, rule)
+	}
+
+	tests := []struct {
+		key    string
+		target string
+		db     int
+		ok     bool
+	}{
+		{"user:tmp:1", "", 1, false},
+		{"user:1:lock", "", 1, false},
+		{"user:12:v1", "u:12:v2", 2, true},
+		{"user:12:name", "u:12name", 1, true},
+		// the first matched rule wins over the later prefix rule
+		{"user:vip:1", "u:vip:1", 1, true},
+		{"user:12:v3", "u:12:v3", 1, true},
+		// a template expanded to an empty key drops the key
+		{"order:1", "", 1, false},
+		{"session:1", "", 0, false},
+	}
+
+	for _, test := range tests {
+		target, db, ok := rules.Rewrite(test.key)
+
+		if target != test.target || db != test.db || ok != test.ok {
+			t.Errorf("'%s' is rewritten to '%s' in db %d %v, wanted '%s' in db %d %v",
+				test.key, target, db, ok, test.target, test.db, test.ok)
+		}
+	}
+
+	if dbs := rules.dbs(); len(dbs) != 3 || dbs[0] != 1 || dbs[1] != 2 || dbs[2] != 3 {
+		t.Errorf("target dbs are %v", dbs)
+	}
+}
+
+func TestLoadRules(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		content string
+		rules   int
+		err     string
+	}{
+		{"# users\n\nprefix user: u:\n  # sessions\ndrop session:\n", 2, ""},
+		{"prefix user: u:\nprefix user:\n", 0, "line 2"},
+		{"# nothing\n\n", 0, "no rule"},
+	}
+
+	for i, test := range tests {
+		fileName := filepath.Join(dir, "rules"+string(rune('0'+i)))
+
+		if err := os.WriteFile(fileName, []byte(test.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		rules, err := LoadRules(fileName, 0)
+
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("load %q failed with %v, wanted '%s'", test.content, err, test.err)
+			}
+
+			continue
+		}
+
+		if err != nil || len(rules) != test.rules {
+			t.Errorf("load %q got %d rules, %v, wanted %d", test.content, len(rules), err, test.rules)
+		}
+	}
+
+	if _, err := LoadRules(filepath.Join(dir, "missing"), 0); err == nil {
+		t.Error("a missing rules file is loaded")
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// staging keys are named by the prefix, the run id and the target key
+const StagingPrefix = "copyer:staging:"
+
+// staging keys of a crashed copy expire after the ttl, it is refreshed by each batch
+const StagingTTL = time.Hour
+
+func (c *Copyer) stagingKey(targetKey string) string {
+	return StagingPrefix + c.runId + ":" + targetKey
+}
+
+func newRunId() string {
+	return strconv.FormatInt(time.Now().UnixNano(), 36)
+}
+
+// write runs a batch write of fn on the target with the expiration in the same transaction, so a key is never left
+// without it, staging keys get StagingTTL instead, it returns errExpired once the source key has expired
+func (c *Copyer) write(key string, expiry *Expiry, fn func(target redis.Cmdable)) (err error) {
+	if expiry.Expired() {
+		return errExpired
+	}
+
+	staging := c.runId != "" && strings.HasPrefix(key, StagingPrefix)
+
+	if !staging && expiry.TTL <= 0 {
+		fn(c.targetClient)
+		return
+	}
+
+	_, err = c.targetClient.TxPipelined(func(pipe redis.Pipeliner) error {
+		fn(pipe)
+
+		if staging {
+			pipe.Expire(key, StagingTTL)
+		} else {
+			c.expire(pipe, key, expiry)
+		}
+
+		return nil
+	})
+
+	return
+}
+
+// copyStaged copies a collection into a staging key, then sets the ttl and renames it over the target in one transaction,
+// so readers never see a partial collection, and a failed copy leaves the target untouched
+func (c *Copyer) copyStaged(kind, sourceKey, targetKey string, expiry *Expiry) (ok bool, err error) {
+	staging := c.stagingKey(targetKey)
+	ok, err = c.copyValue(kind, sourceKey, staging, expiry)
+
+	if err == nil && ok && expiry.Expired() {
+		err = errExpired
+	}
+
+	if err == nil && ok {
+		_, err = c.targetClient.TxPipelined(func(pipe redis.Pipeliner) error {
+			if expiry.TTL > 0 {
+				c.expire(pipe, staging, expiry)
+			} else {
+				pipe.Persist(staging)
+			}
+
+			pipe.Rename(staging, targetKey)
+			return nil
+		})
+	}
+
+	if err != nil || !ok {
+		c.targetClient.Del(staging)
+	}
+
+	return
+}
+
+// Cleanup deletes the staging keys left on the target by crashed copies, before they expire,
+// in the target databases of the rules too
+func (c *Copyer) Cleanup() (deleted int64, err error) {
+	if deleted, err = c.cleanup(); err != nil {
+		return
+	}
+
+	for _, target := range c.targets {
+		if target == c {
+			continue
+		}
+
+		var n int64
+
+		if n, err = target.cleanup(); err != nil {
+			return
+		}
+
+		deleted += n
+	}
+
+	return
+}
+
+func (c *Copyer) cleanup() (deleted int64, err error) {
+	var (
+		cursor uint64
+		keys   []string
+		n      int64
+	)
+
+	for {
+		keys, cursor, err = c.targetClient.Scan(cursor, StagingPrefix+"*", ScanBatchNum).Result()
+
+		if err != nil {
+			return
+		}
+
+		if len(keys) > 0 {
+			n, err = c.targetClient.Del(keys...).Result()
+
+			if err != nil {
+				return
+			}
+
+			deleted += n
+		}
+
+		if cursor == 0 {
+			break
+		}
+	}
+
+	return
+}
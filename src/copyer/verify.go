@@ -0,0 +1,373 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/marsmay/redis-tools/common"
+)
+
+// Verification compares the keys of the prefix on the source and the target, and writes the diff report
+type Verification struct {
+	Tolerance time.Duration
+	Repair    bool
+	Format    string
+	Output    string
+	reporter  common.Reporter
+	lock      sync.Mutex
+	matched   int64
+	missing   int64
+	extra     int64
+	different int64
+	repaired  int64
+}
+
+// KeyState is what is compared of a key
+type KeyState struct {
+	kind   string
+	count  int64
+	ttl    time.Duration
+	digest string
+	// the RDB version of the DUMP payload the digest is made of, 0 for digests of the content
+	version uint16
+}
+
+func (v *Verification) report(status string, key *batchKey, kind, detail string) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	return v.reporter.WriteLine([]string{status, key.source, key.target, kind, detail})
+}
+
+func (v *Verification) Print() {
+	fmt.Fprintf(os.Stderr, "matched: %d, missing: %d, extra: %d, different: %d, repaired: %d\n",
+		v.matched, v.missing, v.extra, v.different, v.repaired)
+}
+
+// readState reads the type, count, ttl and digest of a key, state is nil when the key doesn't exist
+func readState(client redis.Cmdable, key string) (state *KeyState, err error) {
+	kind, err := client.Type(key).Result()
+
+	if err != nil || kind == "none" {
+		return
+	}
+
+	ttl, err := client.PTTL(key).Result()
+
+	if err != nil {
+		return
+	}
+
+	if ttl < 0 {
+		ttl = 0
+	}
+
+	state = &KeyState{kind: kind, ttl: ttl}
+
+	switch kind {
+	case "string":
+		state.count, err = client.StrLen(key).Result()
+	case "list":
+		state.count, err = client.LLen(key).Result()
+	case "set":
+		state.count, err = client.SCard(key).Result()
+	case "zset":
+		state.count, err = client.ZCard(key).Result()
+	case "hash":
+		state.count, err = client.HLen(key).Result()
+	case "stream":
+		state.count, err = client.XLen(key).Result()
+	}
+
+	if err != nil {
+		return
+	}
+
+	state.digest, state.version, err = digestKey(client, kind, key)
+	return
+}
+
+// digestKey hashes the content of a key, strings and lists in order, the other collections by the sum of the hashes
+// of their items, so the digest doesn't depend on the encoding or the item order, zset scores are hashed in the shortest
+// form, which redis 7.2+ replies, other types by their DUMP payload, which depends on the RDB version, version is
+// the RDB version of the payload then
+func digestKey(client redis.Cmdable, kind, key string) (digest string, version uint16, err error) {
+	var (
+		cursor uint64
+		values []string
+		sum    uint64
+		h      = sha1.New()
+	)
+
+	switch kind {
+	case "string":
+		var value string
+
+		if value, err = client.Get(key).Result(); err != nil {
+			return
+		}
+
+		h.Write([]byte(value))
+	case "list":
+		for i := int64(0); ; i += ScanBatchNum {
+			if values, err = client.LRange(key, i, i+ScanBatchNum-1).Result(); err != nil {
+				return
+			}
+
+			for _, value := range values {
+				writeItem(h, value)
+			}
+
+			if len(values) < ScanBatchNum {
+				break
+			}
+		}
+	case "set", "zset", "hash":
+		// scans may return an item more than once, which must be summed once
+		seen := make(map[string]bool, ScanBatchNum)
+
+		for {
+			switch kind {
+			case "set":
+				values, cursor, err = client.SScan(key, cursor, "*", ScanBatchNum).Result()
+			case "zset":
+				values, cursor, err = client.ZScan(key, cursor, "*", ScanBatchNum).Result()
+			default:
+				values, cursor, err = client.HScan(key, cursor, "*", ScanBatchNum).Result()
+			}
+
+			if err != nil {
+				return
+			}
+
+			// zset and hash scans return member and score, or field and value pairs
+			step := 1
+
+			if kind != "set" {
+				step = 2
+			}
+
+			for i := 0; i+step <= len(values); i += step {
+				if seen[values[i]] {
+					continue
+				}
+
+				// redis before 7.2 replies scores by %.17g
+				if kind == "zset" {
+					var score float64
+
+					if score, err = strconv.ParseFloat(values[i+1], 64); err != nil {
+						return
+					}
+
+					values[i+1] = strconv.FormatFloat(score, 'g', -1, 64)
+				}
+
+				seen[values[i]] = true
+				sum += itemHash(values[i : i+step])
+			}
+
+			if cursor == 0 {
+				break
+			}
+		}
+
+		binary.Write(h, binary.BigEndian, sum)
+	default:
+		var payload string
+
+		if payload, err = client.Dump(key).Result(); err != nil {
+			return
+		}
+
+		if version, err = payloadVersion(payload); err != nil {
+			return
+		}
+
+		// the footer holds the RDB version and the checksum
+		h.Write([]byte(payload[:len(payload)-10]))
+	}
+
+	digest = hex.EncodeToString(h.Sum(nil))
+	return
+}
+
+func writeItem(h hash.Hash, value string) {
+	h.Write([]byte(strconv.Itoa(len(value))))
+	h.Write([]byte{':'})
+	h.Write([]byte(value))
+}
+
+func itemHash(items []string) uint64 {
+	h := sha1.New()
+
+	for _, item := range items {
+		writeItem(h, item)
+	}
+
+	return binary.BigEndian.Uint64(h.Sum(nil))
+}
+
+// compareState returns the differences of the target to the source, ttls differ by more than the tolerance
+func compareState(source, target *KeyState, tolerance time.Duration) (diffs []string) {
+	if source.kind != target.kind {
+		return []string{fmt.Sprintf("type %s != %s", source.kind, target.kind)}
+	}
+
+	if source.count != target.count {
+		diffs = append(diffs, fmt.Sprintf("count %d != %d", source.count, target.count))
+	}
+
+	ttlDiff := source.ttl - target.ttl
+
+	if ttlDiff < 0 {
+		ttlDiff = -ttlDiff
+	}
+
+	if (source.ttl == 0) != (target.ttl == 0) || ttlDiff > tolerance {
+		diffs = append(diffs, fmt.Sprintf("ttl %s != %s", source.ttl, target.ttl))
+	}
+
+	// payloads of different RDB versions may encode the same value differently, they are compared by count only
+	if source.digest != target.digest && source.version == target.version {
+		diffs = append(diffs, "digest")
+	}
+
+	return
+}
+
+// verifyBatch compares the source keys of a batch with their target keys
+func (c *Copyer) verifyBatch(batch []*batchKey) (err error) {
+	v := c.verification
+
+	for _, key := range batch {
+		var source, target *KeyState
+
+		if source, err = readState(c.sourceClient, key.source); err != nil {
+			return
+		}
+
+		// the key is gone since the scan
+		if source == nil {
+			continue
+		}
+
+		if target, err = readState(c.targetClient, key.target); err != nil {
+			return
+		}
+
+		status, detail := "", ""
+
+		if target == nil {
+			status = "missing"
+			atomic.AddInt64(&v.missing, 1)
+		} else if diffs := compareState(source, target, v.Tolerance); len(diffs) > 0 {
+			status, detail = "different", strings.Join(diffs, ", ")
+			atomic.AddInt64(&v.different, 1)
+		} else {
+			atomic.AddInt64(&v.matched, 1)
+			continue
+		}
+
+		if err = v.report(status, key, source.kind, detail); err != nil {
+			return
+		}
+
+		if v.Repair {
+			var ok bool
+
+			if ok, _, err = c.copyKey(key.source, key.target); err != nil {
+				return
+			}
+
+			if ok {
+				atomic.AddInt64(&v.repaired, 1)
+			}
+		}
+	}
+
+	return
+}
+
+// extraBatch finds the target keys of a batch without source keys, the walk on the target pairs them the other way,
+// the source of a batch key is the target key
+func (c *Copyer) extraBatch(batch []*batchKey) (err error) {
+	v := c.verification
+	cmds := make([]*redis.IntCmd, len(batch))
+
+	_, err = c.sourceClient.Pipelined(func(pipe redis.Pipeliner) error {
+		for i, key := range batch {
+			cmds[i] = pipe.Exists(key.target)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return
+	}
+
+	for i, key := range batch {
+		if cmds[i].Val() > 0 {
+			continue
+		}
+
+		atomic.AddInt64(&v.extra, 1)
+		pair := &batchKey{source: key.target, target: key.source}
+
+		if err = v.report("extra", pair, "", ""); err != nil {
+			return
+		}
+
+		if v.Repair {
+			if err = c.targetClient.Del(key.source).Err(); err != nil {
+				return
+			}
+
+			atomic.AddInt64(&v.repaired, 1)
+		}
+	}
+
+	return
+}
+
+// Verify walks the prefix on the source for missing and different keys, then on the target for extra keys,
+// repaired keys are copied again with the overwrite policy, and extra keys are deleted
+func (c *Copyer) Verify(sourcePrefix, targetPrefix string, v *Verification) (err error) {
+	v.reporter, err = common.NewReporter(v.Format, v.Output, "copyer", "diff", c.sourceClient.Options().Addr)
+
+	if err != nil {
+		return
+	}
+
+	err = v.reporter.WriteLine([]string{"status", "source key", "target key", "type", "detail"})
+
+	if err != nil {
+		v.reporter.Close()
+		return
+	}
+
+	c.verification, c.conflict = v, ConflictOverwrite
+	err = c.walk(c.sourceClient, escapePattern(sourcePrefix)+"*", prefixMatch(sourcePrefix, targetPrefix), c.verifyBatch, nil)
+
+	if err == nil {
+		err = c.walk(c.targetClient, escapePattern(targetPrefix)+"*", prefixMatch(targetPrefix, sourcePrefix), c.extraBatch, nil)
+	}
+
+	if e := v.reporter.Close(); err == nil {
+		err = e
+	}
+
+	v.Print()
+	return
+}
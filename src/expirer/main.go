@@ -12,6 +12,7 @@ import (
 	"github.com/marsmay/golib/flag2"
 	"github.com/marsmay/golib/math2"
 	"github.com/marsmay/golib/strings2"
+	"github.com/marsmay/redis-tools/common"
 )
 
 const ScanBatchNum = 500
@@ -22,6 +23,7 @@ var (
 	keyExpires flag2.Integers
 	limit      int
 	pika       bool
+	planFile   string
 
 	buildTime string
 	gitHash   string
@@ -36,6 +38,7 @@ func init() {
 	flag.Var(&keyExpires, "e", "")
 	flag.IntVar(&limit, "l", 0, "")
 	flag.BoolVar(&pika, "pika", false, "")
+	flag.StringVar(&planFile, "plan", "", "")
 
 	flag.Usage = func() {
 		fmt.Printf(usage, gitHash, buildTime)
@@ -46,17 +49,11 @@ func main() {
 	// parse flag
 	flag.Parse()
 
-	if len(keyPrefixs) == 0 || len(keyPrefixs) != len(keyExpires) || limit < 0 {
+	if (len(keyPrefixs) == 0 && planFile == "") || len(keyPrefixs) != len(keyExpires) || limit < 0 {
 		flag.Usage()
 		return
 	}
 
-	expires := make(map[string]int, len(keyPrefixs))
-
-	for i := 0; i < len(keyPrefixs); i++ {
-		expires[keyPrefixs[i]] = keyExpires[i]
-	}
-
 	// set max cpu core
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
@@ -69,12 +66,69 @@ func main() {
 
 	client := redis.NewClient(options)
 
+	// process plan
+	var processed int
+
+	if planFile != "" {
+		entries, err := common.ReadPlan(planFile, client)
+
+		if err != nil {
+			log.Fatalf("Fatal Error: read plan failed, file '%s', %s", planFile, err)
+		}
+
+		planKeys := make([]string, 0, ScanBatchNum)
+		planExpires := make(map[string]int, ScanBatchNum)
+
+		// keys of a plan are only deleted by redis-remover
+		for _, entry := range entries {
+			if entry.Action != common.PlanExpire {
+				log.Fatalf("Fatal Error: plan entry '%s%s' is not an expire action, apply the plan by redis-remover", entry.Key, entry.Prefix)
+			}
+		}
+
+		for _, entry := range entries {
+			if entry.TTL <= 0 {
+				continue
+			}
+
+			if entry.Prefix != "" {
+				keyPrefixs = append(keyPrefixs, entry.Prefix)
+				keyExpires = append(keyExpires, int(entry.TTL))
+			} else {
+				planKeys = append(planKeys, entry.Key)
+				planExpires[entry.Key] = int(entry.TTL)
+			}
+
+			if len(planKeys) == ScanBatchNum {
+				processed += expireKeys(client, planKeys, planExpires)
+				planKeys, planExpires = planKeys[:0], make(map[string]int, ScanBatchNum)
+
+				if limit > 0 && processed > limit {
+					return
+				}
+			}
+		}
+
+		if len(planKeys) > 0 {
+			processed += expireKeys(client, planKeys, planExpires)
+		}
+
+		if len(keyPrefixs) == 0 {
+			return
+		}
+	}
+
+	expires := make(map[string]int, len(keyPrefixs))
+
+	for i := 0; i < len(keyPrefixs); i++ {
+		expires[keyPrefixs[i]] = keyExpires[i]
+	}
+
 	// process data
 	var (
-		pattern   string
-		cursor    uint64
-		keys      []string
-		processed int
+		pattern string
+		cursor  uint64
+		keys    []string
 	)
 
 	if len(keyPrefixs) > 1 {
@@ -91,8 +145,8 @@ func main() {
 		}
 
 		var (
-			matchKeys                []string
-			matchExpires, setExpires map[string]int
+			matchKeys    []string
+			matchExpires map[string]int
 		)
 
 		if len(keys) > 0 {
@@ -117,55 +171,61 @@ func main() {
 		}
 
 		if len(matchKeys) > 0 {
-			setExpires = make(map[string]int, len(matchKeys))
+			processed += expireKeys(client, matchKeys, matchExpires)
+		}
 
-			for _, key := range matchKeys {
-				var idle, ttl time.Duration
+		if cursor == 0 {
+			break
+		}
 
-				if !pika {
-					idle, err = client.ObjectIdleTime(key).Result()
+		if limit > 0 && processed > limit {
+			break
+		}
+	}
+}
 
-					if err == redis.Nil {
-						continue
-					}
+// expireKeys sets the expiration of the keys without expiration, minus their idle time
+func expireKeys(client *redis.Client, matchKeys []string, matchExpires map[string]int) int {
+	setExpires := make(map[string]int, len(matchKeys))
 
-					if err != nil {
-						log.Fatalf("Fatal Error: get key info failed, key '%s', %s", key, err)
-					}
-				}
+	for _, key := range matchKeys {
+		var (
+			idle, ttl time.Duration
+			err       error
+		)
 
-				ttl, err = client.TTL(key).Result()
+		if !pika {
+			idle, err = client.ObjectIdleTime(key).Result()
 
-				if err != nil {
-					log.Fatalf("Fatal Error: get key info failed, key '%s', %s", key, err)
-				}
+			if err == redis.Nil {
+				continue
+			}
 
-				if ttl == -1*time.Second {
-					setExpires[key] = math2.Max(0, matchExpires[key]-int(idle/time.Second))
-				}
+			if err != nil {
+				log.Fatalf("Fatal Error: get key info failed, key '%s', %s", key, err)
 			}
 		}
 
-		if len(setExpires) > 0 {
-			for key, expire := range setExpires {
-				err = client.Expire(key, time.Duration(expire)*time.Second).Err()
-
-				if err != nil {
-					log.Fatalf("Fatal Error: expire key failed, key '%s', expire '%d', %s", key, expire, err)
-				}
-
-				fmt.Printf("%s, %d\n", key, expire)
-			}
+		ttl, err = client.TTL(key).Result()
 
-			processed += len(setExpires)
+		if err != nil {
+			log.Fatalf("Fatal Error: get key info failed, key '%s', %s", key, err)
 		}
 
-		if cursor == 0 {
-			break
+		if ttl == -1*time.Second {
+			setExpires[key] = math2.Max(0, matchExpires[key]-int(idle/time.Second))
 		}
+	}
 
-		if limit > 0 && processed > limit {
-			break
+	for key, expire := range setExpires {
+		err := client.Expire(key, time.Duration(expire)*time.Second).Err()
+
+		if err != nil {
+			log.Fatalf("Fatal Error: expire key failed, key '%s', expire '%d', %s", key, expire, err)
 		}
+
+		fmt.Printf("%s, %d\n", key, expire)
 	}
+
+	return len(setExpires)
 }
@@ -4,5 +4,7 @@ go 1.18
 
 require (
 	github.com/go-redis/redis v6.15.9+incompatible
+	github.com/golang/snappy v1.0.0
+	github.com/klauspost/compress v1.15.15
 	github.com/marsmay/golib v1.18.5
 )
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis"
+)
+
+// lower bounds of the LFU counter buckets, the counter is logarithmic and new keys start at 5
+var freqBounds = []int64{0, 5, 10, 20, 50, 100, 200}
+
+type HotKey struct {
+	db   int
+	key  string
+	kind string
+	freq int64
+}
+
+// HotKeys keeps the hottest keys in a min heap, index holds the heap positions by db and key
+type HotKeys struct {
+	keys  []*HotKey
+	index map[string]int
+}
+
+func hotKeyId(db int, key string) string {
+	return strconv.Itoa(db) + ":" + key
+}
+
+func (h *HotKeys) Len() int           { return len(h.keys) }
+func (h *HotKeys) Less(i, j int) bool { return h.keys[i].freq < h.keys[j].freq }
+
+func (h *HotKeys) Swap(i, j int) {
+	h.keys[i], h.keys[j] = h.keys[j], h.keys[i]
+	h.index[hotKeyId(h.keys[i].db, h.keys[i].key)] = i
+	h.index[hotKeyId(h.keys[j].db, h.keys[j].key)] = j
+}
+
+func (h *HotKeys) Push(x interface{}) {
+	key := x.(*HotKey)
+	h.index[hotKeyId(key.db, key.key)] = len(h.keys)
+	h.keys = append(h.keys, key)
+}
+
+func (h *HotKeys) Pop() interface{} {
+	n := len(h.keys)
+	x := h.keys[n-1]
+	h.keys = h.keys[:n-1]
+	delete(h.index, hotKeyId(x.db, x.key))
+	return x
+}
+
+// Add keeps the key when it's hotter than the coldest kept key, a key sampled again by RANDOMKEY is only updated
+func (h *HotKeys) Add(key *HotKey, limit int) {
+	if h.index == nil {
+		h.index = make(map[string]int, limit)
+	}
+
+	id := hotKeyId(key.db, key.key)
+
+	if i, ok := h.index[id]; ok {
+		if v := h.keys[i]; key.freq > v.freq {
+			v.freq = key.freq
+			heap.Fix(h, i)
+		}
+
+		return
+	}
+
+	if h.Len() < limit {
+		heap.Push(h, key)
+	} else if h.keys[0].freq < key.freq {
+		delete(h.index, hotKeyId(h.keys[0].db, h.keys[0].key))
+		h.keys[0], h.index[id] = key, 0
+		heap.Fix(h, 0)
+	}
+}
+
+func freqBucket(freq int64) int {
+	for i := len(freqBounds) - 1; i > 0; i-- {
+		if freq >= freqBounds[i] {
+			return i
+		}
+	}
+
+	return 0
+}
+
+func freqBucketName(i int) string {
+	if i == len(freqBounds)-1 {
+		return fmt.Sprintf("freq >=%d", freqBounds[i])
+	}
+
+	return fmt.Sprintf("freq %d-%d", freqBounds[i], freqBounds[i+1]-1)
+}
+
+// checkPolicy makes sure the LFU counters are maintained, OBJECT FREQ fails under LRU policies
+func (i *Idler) checkPolicy() (err error) {
+	values, err := i.client.ConfigGet("maxmemory-policy").Result()
+
+	if err != nil {
+		return fmt.Errorf("get maxmemory-policy failed, %s", err)
+	}
+
+	if len(values) < 2 {
+		return fmt.Errorf("get maxmemory-policy failed, empty result")
+	}
+
+	policy, _ := values[1].(string)
+
+	if !strings.Contains(policy, "lfu") {
+		return fmt.Errorf("maxmemory-policy is '%s', hot key mode needs an LFU policy (allkeys-lfu or volatile-lfu), "+
+			"under other policies redis only tracks the last access time of keys, not the access frequency, use the idle mode instead", policy)
+	}
+
+	return
+}
+
+func getFreq(client *redis.Client, key string) (freq int64, err error) {
+	return client.Do("object", "freq", key).Int64()
+}
+
+func (i *Idler) hotHeader() []string {
+	header := []string{"avg freq"}
+
+	for b := range freqBounds {
+		header = append(header, freqBucketName(b))
+	}
+
+	return header
+}
+
+func (i *Idler) hotLine(v *Result) []string {
+	line := []string{strconv.FormatInt(v.freq, 10)}
+
+	for _, num := range v.freqs {
+		line = append(line, strconv.FormatInt(num, 10))
+	}
+
+	return line
+}
+
+func (i *Idler) saveHotKeys() (err error) {
+	reporter, err := i.newReporter("hotkeys")
+
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if e := reporter.Close(); err == nil {
+			err = e
+		}
+	}()
+
+	keys := make([]*HotKey, len(i.hotKeys.keys))
+	copy(keys, i.hotKeys.keys)
+
+	sort.Slice(keys, func(a, b int) bool {
+		if keys[a].freq != keys[b].freq {
+			return keys[a].freq > keys[b].freq
+		}
+
+		return keys[a].key < keys[b].key
+	})
+
+	err = reporter.WriteLine([]string{"db", "key", "type", "freq"})
+
+	if err != nil {
+		return
+	}
+
+	for _, key := range keys {
+		err = reporter.WriteLine([]string{strconv.Itoa(key.db), key.key, key.kind, strconv.FormatInt(key.freq, 10)})
+
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
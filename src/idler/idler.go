@@ -2,12 +2,13 @@ package main
 
 import (
 	"fmt"
-	"path"
+	"log"
+	"os"
+	"sort"
 	"strconv"
 	"time"
 
 	"github.com/go-redis/redis"
-	"github.com/marsmay/golib/csv"
 	"github.com/marsmay/golib/math2"
 	"github.com/marsmay/redis-tools/common"
 )
@@ -15,41 +16,141 @@ import (
 const BarWidth = 64
 const ScanBatchNum = 500
 
+// tree index of all databases in merged mode
+const MergedDB = -1
+
 type Result struct {
+	db        string
 	prefix    string
 	kind      string
 	num       int64
+	numLow    int64
+	numHigh   int64
 	idleNum   int64
+	idleSize  int64
+	sizeRatio float64
+	size      int64
+	idleNums  []int64
+	idleSizes []int64
 	idleTime  int64
 	idleRatio float64
 	ttl       int64
+	freq      int64
+	freqs     []int64
 	sample    string
 }
 
 type Idler struct {
 	client    *redis.Client
-	reporter  *csv.Writer
+	master    *redis.Client
+	clients   map[int]*redis.Client
+	dbs       []int
+	allDB     bool
+	mergeDB   bool
+	reporter  common.Reporter
+	format    string
+	output    string
+	instance  string
 	separator string
-	tree      *common.Tree
+	idles     []int64
+	hotNum    int
+	hotKeys   *HotKeys
+	plan      *Plan
+	noMemory  bool
+	noTouch   bool
+	keysLen   int
+	mergeLen  int
+	sampleNum int64
+	sampled   map[int]int64
+	totals    map[int]int64
+	trees     map[int]*common.Tree
 	results   []*Result
 }
 
-func (i *Idler) calcNode(node *common.Node, name string) {
+func (i *Idler) getTree(db int) *common.Tree {
+	if i.mergeDB {
+		db = MergedDB
+	}
+
+	if i.trees[db] == nil {
+		i.trees[db] = common.NewTree(i.separator, i.keysLen, i.mergeLen, func(node *common.Node, data map[string]int64) {
+			if i.hotNum > 0 {
+				node.Data["freq"] += data["freq"]
+				node.Data["freq_"+strconv.Itoa(freqBucket(data["freq"]))]++
+			} else {
+				for _, idle := range i.idles {
+					if data["idle"] <= idle {
+						break
+					}
+
+					node.Data[idleNumKey(idle)]++
+					node.Data[idleSizeKey(idle)] += data["size"]
+				}
+
+				if data["idle"] > i.idles[0] {
+					node.Data["idle_time"] += data["idle"]
+				}
+			}
+
+			node.Data["ttl"] += data["ttl"]
+			node.Data["size"] += data["size"]
+
+			if i.mergeDB {
+				node.Data["db"+strconv.FormatInt(data["db"], 10)]++
+			}
+		})
+	}
+
+	return i.trees[db]
+}
+
+func (i *Idler) calcNode(node *common.Node, name string, db int) {
 	if node.Childrens == nil {
 		result := &Result{
-			prefix:  name,
-			kind:    node.Kind,
-			num:     node.Num,
-			idleNum: node.Data["idle_num"],
+			db:        strconv.Itoa(db),
+			prefix:    name,
+			kind:      node.Kind,
+			num:       node.Num,
+			size:      node.Data["size"],
+			idleNums:  make([]int64, len(i.idles)),
+			idleSizes: make([]int64, len(i.idles)),
 		}
 
-		if node.Data["idle_num"] > 0 {
-			result.idleTime = node.Data["idle_time"] / node.Data["idle_num"]
+		for t, idle := range i.idles {
+			result.idleNums[t] = node.Data[idleNumKey(idle)]
+			result.idleSizes[t] = node.Data[idleSizeKey(idle)]
+		}
+
+		result.idleNum, result.idleSize = result.idleNums[0], result.idleSizes[0]
+
+		if result.size > 0 {
+			result.sizeRatio = math2.Percent[int64, float64](result.idleSize, result.size, 2)
+		}
+
+		if result.idleNum > 0 {
+			result.idleTime = node.Data["idle_time"] / result.idleNum
 		}
 
 		if node.Num > 0 {
-			result.idleRatio = math2.Percent[int64, float64](node.Data["idle_num"], node.Num, 2)
+			result.idleRatio = math2.Percent[int64, float64](result.idleNum, node.Num, 2)
 			result.ttl = node.Data["ttl"] / node.Num
+			result.freq = node.Data["freq"] / node.Num
+		}
+
+		if i.hotNum > 0 {
+			result.freqs = make([]int64, len(freqBounds))
+
+			for b := range freqBounds {
+				result.freqs[b] = node.Data["freq_"+strconv.Itoa(b)]
+			}
+		}
+
+		if db == MergedDB {
+			result.db = common.FormatDBs(node.Data)
+		}
+
+		if i.sampleNum > 0 {
+			i.scaleResult(result, node, db)
 		}
 
 		if len(node.Keys) > 0 {
@@ -59,13 +160,81 @@ func (i *Idler) calcNode(node *common.Node, name string) {
 		i.results = append(i.results, result)
 	} else {
 		for _, v := range node.Childrens {
-			i.calcNode(v, name+i.separator+v.Name)
+			i.calcNode(v, name+i.separator+v.Name, db)
+		}
+	}
+}
+
+func (i *Idler) addKey(client *redis.Client, tree *common.Tree, db int, key string, noExpire bool) (err error) {
+	kind, err := client.Type(key).Result()
+
+	if err != nil || kind == "none" {
+		return
+	}
+
+	// TYPE, OBJECT, MEMORY USAGE and TTL don't update the access time, and the idle time is read before anything else
+	var idle time.Duration
+	var freq, size int64
+
+	if i.hotNum > 0 {
+		freq, err = getFreq(client, key)
+	} else {
+		idle, err = client.ObjectIdleTime(key).Result()
+	}
+
+	if err == redis.Nil {
+		err = nil
+		return
+	}
+
+	if err != nil {
+		return
+	}
+
+	// memory is read after the idle time, it is needed for the idle bytes percent of all keys
+	if i.hotNum == 0 {
+		size, err = i.keyMemory(client, kind, key)
+
+		if err == redis.Nil {
+			err = nil
+			return
+		}
+
+		if err != nil {
+			return
+		}
+	}
+
+	ttl, err := client.TTL(key).Result()
+
+	if err != nil {
+		return
+	}
+
+	if !noExpire || ttl == -time.Second {
+		tree.AddNode(key, kind, map[string]int64{
+			"idle": idle.Milliseconds() / 1e3,
+			"ttl":  ttl.Milliseconds() / 1e3,
+			"freq": freq,
+			"size": size,
+			"db":   int64(db),
+		})
+
+		if i.hotNum == 0 && idle.Seconds() > float64(i.idles[0]) {
+			i.addPlanKey(db, key, kind)
+		}
+
+		if i.hotNum > 0 {
+			i.hotKeys.Add(&HotKey{db: db, key: key, kind: kind, freq: freq}, i.hotNum)
 		}
 	}
+
+	return
 }
 
-func (i *Idler) Run(noExpire bool) (err error) {
-	total, err := i.client.DBSize().Result()
+func (i *Idler) scan(db int, noExpire bool) (err error) {
+	client, tree := i.clients[db], i.getTree(db)
+	total, err := client.DBSize().Result()
 
 	if err != nil {
 		return
@@ -78,126 +247,423 @@ func (i *Idler) Run(noExpire bool) (err error) {
 	)
 
 	for {
-		keys, cursor, err = i.client.Scan(cursor, "*", ScanBatchNum).Result()
+		keys, cursor, err = client.Scan(cursor, "*", ScanBatchNum).Result()
 
 		if err != nil {
 			return
 		}
 
 		if len(keys) > 0 {
-			var (
-				kind      string
-				idle, ttl time.Duration
-			)
-
 			for _, key := range keys {
-				kind, err = i.client.Type(key).Result()
+				err = i.addKey(client, tree, db, key, noExpire)
 
 				if err != nil {
 					return
 				}
 
-				idle, err = i.client.ObjectIdleTime(key).Result()
+				processed++
+			}
 
-				if err == redis.Nil {
-					err = nil
-					continue
-				}
+			common.ProgressBar(BarWidth, processed, total, fmt.Sprintf("scan db%d keys ...", db))
+		}
 
-				if err != nil {
-					return
-				}
+		if cursor == 0 {
+			break
+		}
+	}
 
-				ttl, err = i.client.TTL(key).Result()
+	fmt.Fprintln(os.Stderr)
+	return
+}
 
-				if err != nil {
-					return
-				}
+func (i *Idler) sample(db int, noExpire bool) (err error) {
+	client, tree := i.clients[db], i.getTree(db)
+	total, err := client.DBSize().Result()
 
-				if !noExpire || ttl == -time.Second {
-					i.tree.AddNode(key, kind, map[string]int64{
-						"idle": idle.Milliseconds() / 1e3,
-						"ttl":  ttl.Milliseconds() / 1e3,
-					})
-				}
+	if err != nil {
+		return
+	}
 
-				processed++
-			}
+	i.totals[db] = total
 
-			common.ProgressBar(BarWidth, processed, total, "scan keys ...")
-		}
+	var key string
 
-		if cursor == 0 {
+	for i.sampled[db] < i.sampleNum {
+		key, err = client.RandomKey().Result()
+
+		if err == redis.Nil {
+			err = nil
 			break
 		}
+
+		if err != nil {
+			return
+		}
+
+		err = i.addKey(client, tree, db, key, noExpire)
+
+		if err != nil {
+			return
+		}
+
+		i.sampled[db]++
+
+		if i.sampled[db]%ScanBatchNum == 0 || i.sampled[db] == i.sampleNum {
+			common.ProgressBar(BarWidth, i.sampled[db], i.sampleNum, fmt.Sprintf("sample db%d keys ...", db))
+		}
 	}
 
-	fmt.Println()
+	fmt.Fprintln(os.Stderr)
 	return
 }
 
-func (i *Idler) Save() (err error) {
+// scaleResult scales the sampled counts of a result to the database size
+func (i *Idler) scaleResult(result *Result, node *common.Node, db int) {
+	counts := map[int]int64{db: node.Num}
+
+	if db == MergedDB {
+		counts = common.DBCounts(node.Data)
+	}
+
+	var estimate, variance float64
 
-	for _, node := range i.tree.Nodes {
-		i.calcNode(node, node.Name)
+	for d, hit := range counts {
+		e, v := common.Estimate(hit, i.sampled[d], i.totals[d])
+		estimate += e
+		variance += v
 	}
 
-	err = i.reporter.WriteLine([]string{"prefix", "type", "num", "idle num", "avg idle", "idle percent", "avg ttl", "sample"})
+	if node.Num > 0 {
+		scale := estimate / float64(node.Num)
+		result.idleNum = int64(float64(result.idleNum) * scale)
+		result.idleSize = int64(float64(result.idleSize) * scale)
+		result.size = int64(float64(result.size) * scale)
+
+		for t := range result.idleNums {
+			result.idleNums[t] = int64(float64(result.idleNums[t]) * scale)
+			result.idleSizes[t] = int64(float64(result.idleSizes[t]) * scale)
+		}
+
+		for b, num := range result.freqs {
+			result.freqs[b] = int64(float64(num) * scale)
+		}
+	}
+
+	result.num = int64(estimate)
+	result.numLow, result.numHigh = common.ConfidenceInterval(estimate, variance)
+}
+
+func (i *Idler) Run(noExpire bool, plan *Plan) (err error) {
+	i.plan = plan
+
+	if i.hotNum > 0 {
+		err = i.checkPolicy()
+
+		if err != nil {
+			return
+		}
+	}
+
+	if i.master != nil {
+		log.Printf("Warning: idle times are read on replica '%s', they reflect the reads served by the replica and the writes "+
+			"replicated from the master, reads served by the master are not counted", i.client.Options().Addr)
+		common.LogReplicaLag(i.master, i.client, "start")
+		defer common.LogReplicaLag(i.master, i.client, "end")
+	}
+
+	if i.allDB {
+		i.dbs, err = common.KeyspaceDBs(i.client)
+
+		if err != nil {
+			return
+		}
+
+		i.clients = common.NewDBClients(i.client.Options(), i.dbs)
+	}
+
+	for _, db := range i.dbs {
+		if i.sampleNum > 0 {
+			err = i.sample(db, noExpire)
+		} else {
+			err = i.scan(db, noExpire)
+		}
+
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func sortResults(results []*Result, sortBy string) {
+	var value func(v *Result) float64
+
+	switch sortBy {
+	case "num":
+		value = func(v *Result) float64 { return float64(v.num) }
+	case "ttl":
+		value = func(v *Result) float64 { return float64(v.ttl) }
+	case "freq":
+		value = func(v *Result) float64 { return float64(v.freq) }
+	case "size":
+		value = func(v *Result) float64 { return float64(v.idleSize) }
+	default:
+		value = func(v *Result) float64 { return v.idleRatio }
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		if vi, vj := value(results[i]), value(results[j]); vi != vj {
+			return vi > vj
+		}
+
+		return results[i].prefix < results[j].prefix
+	})
+}
+
+func (i *Idler) Save(filter *common.Filter, sortBy string, top int) (err error) {
+	dbs := i.dbs
+
+	if i.mergeDB {
+		dbs = []int{MergedDB}
+	}
+
+	for _, db := range dbs {
+		if tree := i.trees[db]; tree != nil {
+			for _, node := range tree.Nodes {
+				i.calcNode(node, node.Name, db)
+			}
+		}
+	}
+
+	results := make([]*Result, 0, len(i.results))
+
+	for _, v := range i.results {
+		if (v.idleNum > 0 || i.hotNum > 0) && filter.Match(v.prefix, v.kind, v.num) && filter.MatchSize(v.idleSize) {
+			results = append(results, v)
+		}
+	}
+
+	sortResults(results, sortBy)
+
+	if top > 0 && len(results) > top {
+		results = results[:top]
+	}
+
+	header := []string{"db", "prefix", "type", "num"}
+
+	if i.sampleNum > 0 {
+		header = append(header, "num low", "num high")
+	}
+
+	if i.hotNum > 0 {
+		header = append(header, i.hotHeader()...)
+	} else {
+		header = append(header, "idle num", "idle bytes", "idle bytes percent", "avg idle", "idle percent")
+
+		for _, idle := range i.idles[1:] {
+			header = append(header, "idle num >"+formatIdle(idle), "idle bytes >"+formatIdle(idle))
+		}
+	}
+
+	header = append(header, "avg ttl", "sample")
+	err = i.reporter.WriteLine(header)
 
 	if err != nil {
+		i.reporter.Close()
 		return
 	}
 
-	for _, v := range i.results {
-		if v.idleNum > 0 {
-			err = i.reporter.WriteLine([]string{
-				v.prefix,
-				v.kind,
-				strconv.FormatInt(v.num, 10),
+	for _, v := range results {
+		line := []string{
+			v.db,
+			v.prefix,
+			v.kind,
+			strconv.FormatInt(v.num, 10),
+		}
+
+		if i.sampleNum > 0 {
+			line = append(line, strconv.FormatInt(v.numLow, 10), strconv.FormatInt(v.numHigh, 10))
+		}
+
+		if i.hotNum > 0 {
+			line = append(line, i.hotLine(v)...)
+		} else {
+			line = append(line,
 				strconv.FormatInt(v.idleNum, 10),
+				strconv.FormatInt(v.idleSize, 10),
+				fmt.Sprintf("%.2f%%", v.sizeRatio),
 				strconv.FormatInt(v.idleTime, 10),
 				fmt.Sprintf("%.2f%%", v.idleRatio),
-				strconv.FormatInt(v.ttl, 10),
-				v.sample,
-			})
+			)
 
-			if err != nil {
-				return
+			for t := 1; t < len(i.idles); t++ {
+				line = append(line, strconv.FormatInt(v.idleNums[t], 10), strconv.FormatInt(v.idleSizes[t], 10))
 			}
 		}
+
+		line = append(line, strconv.FormatInt(v.ttl, 10), v.sample)
+		err = i.reporter.WriteLine(line)
+
+		if err != nil {
+			i.reporter.Close()
+			return
+		}
 	}
 
-	i.reporter.Close()
-	return
+	err = i.reporter.Close()
+
+	if err != nil {
+		return
+	}
+
+	if i.hotNum == 0 {
+		i.printTotal()
+
+		if i.plan != nil {
+			err = i.savePlan(results, filter)
+		}
+
+		return
+	}
+
+	if i.format == "prom" {
+		log.Printf("Warning: hot keys are not written in format 'prom'")
+		return
+	}
+
+	return i.saveHotKeys()
+}
+
+// printTotal prints the reclaimable memory of the idle keys of all rows, before filtering
+func (i *Idler) printTotal() {
+	var size, idleSize, idleNum int64
+
+	for _, v := range i.results {
+		size += v.size
+		idleSize += v.idleSize
+		idleNum += v.idleNum
+	}
+
+	fmt.Fprintf(os.Stderr, "reclaimable memory: %d bytes of %d idle keys, %.2f%% of %d bytes\n",
+		idleSize, idleNum, math2.Percent[int64, float64](idleSize, size, 2), size)
+}
+
+func idleNumKey(idle int64) string {
+	return "idle_num_" + strconv.FormatInt(idle, 10)
+}
+
+func idleSizeKey(idle int64) string {
+	return "idle_size_" + strconv.FormatInt(idle, 10)
+}
+
+// formatIdle formats the idle seconds in the largest whole unit, like 7d or 90m
+func formatIdle(idle int64) string {
+	switch {
+	case idle%86400 == 0:
+		return strconv.FormatInt(idle/86400, 10) + "d"
+	case idle%3600 == 0:
+		return strconv.FormatInt(idle/3600, 10) + "h"
+	case idle%60 == 0:
+		return strconv.FormatInt(idle/60, 10) + "m"
+	}
+
+	return strconv.FormatInt(idle, 10) + "s"
+}
+
+func (i *Idler) newReporter(report string) (reporter common.Reporter, err error) {
+	return common.NewReporter(i.format, i.output, "idler", report, i.instance)
+}
+
+func (i *Idler) Close() {
+	for _, client := range i.clients {
+		if client != i.client {
+			client.Close()
+		}
+	}
+
+	if i.master != nil {
+		i.master.Close()
+	}
+
+	i.client.Close()
 }
 
-func NewIdler(url string, separator string, idle int64, keysLen, mergeLen int, output string) (idler *Idler, err error) {
+func NewIdler(url string, separator string, idles []int, hotNum int, keysLen, mergeLen int, sampleNum int64, format, output string, allDB, mergeDB, replica bool) (idler *Idler, err error) {
 	options, err := redis.ParseURL(url)
 
 	if err != nil {
 		return
 	}
 
-	fileName := path.Join(output, fmt.Sprintf("keys-%s-%s.csv", options.Addr, time.Now().Format("20060102150405")))
-	reporter, err := csv.NewWriter(fileName)
+	// reports keep the name of the url instance
+	instance := options.Addr
+	var master *redis.Client
+
+	if replica {
+		options, master, err = common.UseReplica(options)
+
+		if err != nil {
+			return
+		}
+	}
+
+	// only the length estimates without MEMORY USAGE touch keys, they are skipped on servers without NO-TOUCH
+	noTouch, _, err := common.NoTouch(options)
+
+	if err != nil {
+		if master != nil {
+			master.Close()
+		}
+
+		return
+	}
+
+	reporter, err := common.NewReporter(format, output, "idler", "keys", instance)
 
 	if err != nil {
+		if master != nil {
+			master.Close()
+		}
+
 		return
 	}
 
+	client := redis.NewClient(options)
+
+	// thresholds are ascending, so the first one counts all idle keys
+	sort.Ints(idles)
+	thresholds := make([]int64, 0, len(idles))
+
+	for t, idle := range idles {
+		if t == 0 || idle != idles[t-1] {
+			thresholds = append(thresholds, int64(idle))
+		}
+	}
+
 	idler = &Idler{
-		client:    redis.NewClient(options),
+		client:    client,
+		master:    master,
+		clients:   map[int]*redis.Client{options.DB: client},
+		dbs:       []int{options.DB},
+		allDB:     allDB,
+		mergeDB:   allDB && mergeDB,
 		separator: separator,
 		reporter:  reporter,
-		tree: common.NewTree(separator, keysLen, mergeLen, func(node *common.Node, data map[string]int64) {
-			if data["idle"] > idle {
-				node.Data["idle_num"]++
-				node.Data["idle_time"] += data["idle"]
-			}
-
-			node.Data["ttl"] += data["ttl"]
-		}),
-		results: make([]*Result, 0, 256),
+		format:    format,
+		output:    output,
+		instance:  instance,
+		idles:     thresholds,
+		hotNum:    hotNum,
+		hotKeys:   &HotKeys{},
+		noTouch:   noTouch,
+		keysLen:   keysLen,
+		mergeLen:  mergeLen,
+		sampleNum: sampleNum,
+		sampled:   make(map[int]int64, 16),
+		totals:    make(map[int]int64, 16),
+		trees:     make(map[int]*common.Tree, 16),
+		results:   make([]*Result, 0, 256),
 	}
 	return
 }
@@ -7,16 +7,32 @@ import (
 	"fmt"
 	"log"
 	"runtime"
+	"time"
+
+	"github.com/marsmay/golib/flag2"
+	"github.com/marsmay/redis-tools/common"
 )
 
 var (
 	redisUrl    string
 	separator   string
-	idleSeconds int64
+	idleSeconds flag2.Integers
+	hotNum      int
 	keysLen     int
 	mergeLen    int
+	sampleNum   int64
 	noExpire    bool
+	format      string
 	output      string
+	allDB       bool
+	mergeDB     bool
+	replica     bool
+	interval    time.Duration
+	listen      string
+	sortBy      string
+	top         int
+	filter      = &common.Filter{}
+	plan        = &Plan{}
 
 	buildTime string
 	gitHash   string
@@ -28,11 +44,29 @@ var (
 func init() {
 	flag.StringVar(&redisUrl, "u", "redis://127.0.0.1:6379/0", "")
 	flag.StringVar(&separator, "s", "", "")
-	flag.Int64Var(&idleSeconds, "i", 86400*7, "")
+	flag.Var(&idleSeconds, "i", "")
+	flag.IntVar(&hotNum, "hot", 0, "")
 	flag.IntVar(&keysLen, "sn", 10, "")
 	flag.IntVar(&mergeLen, "mn", 20, "")
+	flag.Int64Var(&sampleNum, "rn", 0, "")
 	flag.BoolVar(&noExpire, "n", false, "")
+	flag.StringVar(&format, "f", "csv", "")
 	flag.StringVar(&output, "o", "./", "")
+	flag.BoolVar(&allDB, "all-db", false, "")
+	flag.BoolVar(&mergeDB, "merge-db", false, "")
+	flag.BoolVar(&replica, "replica", false, "")
+	flag.DurationVar(&interval, "d", 0, "")
+	flag.StringVar(&listen, "l", "", "")
+	flag.StringVar(&sortBy, "sort", "", "")
+	flag.IntVar(&top, "top", 0, "")
+	flag.Int64Var(&filter.MinNum, "min-num", 0, "")
+	flag.Int64Var(&filter.MinSize, "min-size", 0, "")
+	flag.Var((*flag2.Strings)(&filter.Kinds), "type", "")
+	flag.Var((*flag2.Strings)(&filter.Includes), "include", "")
+	flag.Var((*flag2.Strings)(&filter.Excludes), "exclude", "")
+	flag.StringVar(&plan.File, "plan", "", "")
+	flag.BoolVar(&plan.Keys, "plan-keys", false, "")
+	flag.StringVar(&plan.Action, "plan-action", common.PlanExpire, "")
 
 	flag.Usage = func() {
 		fmt.Printf(usage, gitHash, buildTime)
@@ -43,7 +77,20 @@ func main() {
 	// parse flag
 	flag.Parse()
 
-	if separator == "" || idleSeconds <= 0 || keysLen <= 0 || mergeLen <= 0 || output == "" {
+	// idle percent is always 0 in hot mode, rows are sorted by freq instead
+	if sortBy == "" {
+		if hotNum > 0 {
+			sortBy = "freq"
+		} else {
+			sortBy = "idle"
+		}
+	}
+
+	if len(idleSeconds) == 0 {
+		idleSeconds = flag2.Integers{86400 * 7}
+	}
+
+	if separator == "" || !validIdles(idleSeconds) || hotNum < 0 || keysLen <= 0 || mergeLen <= 0 || sampleNum < 0 || format == "" || output == "" || interval < 0 || (listen != "" && interval == 0) || !validSort(sortBy) || top < 0 || (plan.File != "" && (hotNum > 0 || !validPlanAction(plan.Action, plan.Keys))) {
 		flag.Usage()
 		return
 	}
@@ -51,24 +98,78 @@ func main() {
 	// set max cpu core
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
+	// serve metrics
+	if listen != "" {
+		format, output = "prom", common.Metrics
+		common.ServeMetrics(listen)
+	}
+
+	for {
+		err := run()
+
+		if interval <= 0 {
+			if err != nil {
+				log.Fatalf("Fatal Error: %s", err)
+			}
+
+			break
+		}
+
+		if err != nil {
+			log.Printf("Warning: %s", err)
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+func run() (err error) {
 	// init idler
-	idler, err := NewIdler(redisUrl, separator, idleSeconds, keysLen, mergeLen, output)
+	idler, err := NewIdler(redisUrl, separator, idleSeconds, hotNum, keysLen, mergeLen, sampleNum, format, output, allDB, mergeDB, replica)
 
 	if err != nil {
-		log.Fatalf("Fatal Error: init idler failed, redis url '%s', output '%s', %s", redisUrl, output, err)
+		return fmt.Errorf("init idler failed, redis url '%s', output '%s', %s", redisUrl, output, err)
 	}
 
+	defer idler.Close()
+
 	// do parse
-	err = idler.Run(noExpire)
+	// the idle keys of a plan are collected by each run
+	if plan.File != "" {
+		err = idler.Run(noExpire, &Plan{File: plan.File, Keys: plan.Keys, Action: plan.Action})
+	} else {
+		err = idler.Run(noExpire, nil)
+	}
 
 	if err != nil {
-		log.Fatalf("Fatal Error: parse idle data failed, %s", err)
+		return fmt.Errorf("parse idle data failed, %s", err)
 	}
 
 	// save report
-	err = idler.Save()
+	err = idler.Save(filter, sortBy, top)
 
 	if err != nil {
-		log.Fatalf("Fatal Error: save report failed, %s", err)
+		return fmt.Errorf("save report failed, %s", err)
+	}
+
+	return
+}
+
+func validSort(sortBy string) bool {
+	switch sortBy {
+	case "idle", "num", "ttl", "freq", "size":
+		return true
+	}
+
+	return false
+}
+
+func validIdles(idles []int) bool {
+	for _, idle := range idles {
+		if idle <= 0 {
+			return false
+		}
 	}
+
+	return true
 }
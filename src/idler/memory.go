@@ -0,0 +1,77 @@
+package main
+
+import (
+	"log"
+	"strings"
+
+	"github.com/go-redis/redis"
+	"github.com/marsmay/redis-tools/common"
+)
+
+// assumed length of collection items when MEMORY USAGE is not supported
+const EstimateItemLen = 16
+
+// keyMemory returns the MEMORY USAGE of the key, or a type-specific estimate by its length on servers without MEMORY USAGE,
+// the estimate is skipped without CLIENT NO-TOUCH, since the length commands update the access time of keys
+func (i *Idler) keyMemory(client *redis.Client, kind, key string) (size int64, err error) {
+	if !i.noMemory {
+		size, err = client.MemoryUsage(key).Result()
+
+		if err == nil || err == redis.Nil {
+			return
+		}
+
+		// only fall back on server errors like unknown command, not on network errors
+		if !strings.HasPrefix(err.Error(), "ERR") {
+			return
+		}
+
+		if i.noTouch {
+			log.Printf("Warning: MEMORY USAGE is not supported, %s, idle bytes are estimated by the length of keys", err)
+		} else {
+			log.Printf("Warning: MEMORY USAGE is not supported, %s, idle bytes are not reported, "+
+				"estimating them by the length of keys would update the access time without CLIENT NO-TOUCH", err)
+		}
+
+		i.noMemory = true
+	}
+
+	if !i.noTouch {
+		return 0, nil
+	}
+
+	return estimateMemory(client, kind, key)
+}
+
+func estimateMemory(client *redis.Client, kind, key string) (size int64, err error) {
+	var num int64
+
+	switch kind {
+	case "string":
+		num, err = client.StrLen(key).Result()
+	case "list":
+		num, err = client.LLen(key).Result()
+	case "hash":
+		num, err = client.HLen(key).Result()
+	case "set":
+		num, err = client.SCard(key).Result()
+	case "zset":
+		num, err = client.ZCard(key).Result()
+	case "stream":
+		num, err = client.XLen(key).Result()
+	}
+
+	if err != nil {
+		return
+	}
+
+	size = common.MallocSize(common.DictEntrySize) + common.SdsSize(int64(len(key)))
+
+	if kind == "string" {
+		size += common.StringSize(num)
+	} else {
+		size += num * (common.MallocSize(common.DictEntrySize) + common.StringSize(EstimateItemLen))
+	}
+
+	return
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/marsmay/redis-tools/common"
+)
+
+// Plan writes the idle keys, or the prefixes of the report rows with a suggested ttl, for redis-remover and redis-expirer,
+// only exact keys can be deleted
+type Plan struct {
+	File   string
+	Keys   bool
+	Action string
+	keys   []*PlanKey
+}
+
+type PlanKey struct {
+	common.PlanEntry
+	kind string
+}
+
+func validPlanAction(action string, keys bool) bool {
+	return action == common.PlanExpire || (action == common.PlanDelete && keys)
+}
+
+// addPlanKey keeps an idle key for the plan, the ttl, or the idle time checked again before delete,
+// is the smallest idle threshold
+func (i *Idler) addPlanKey(db int, key, kind string) {
+	if i.plan == nil || !i.plan.Keys {
+		return
+	}
+
+	entry := common.PlanEntry{DB: db, Action: i.plan.Action, Key: key}
+
+	if entry.Action == common.PlanDelete {
+		entry.Idle = i.idles[0]
+	} else {
+		entry.TTL = i.idles[0]
+	}
+
+	i.plan.keys = append(i.plan.keys, &PlanKey{PlanEntry: entry, kind: kind})
+}
+
+// planPrefix returns the real key prefix of a row, the tree moves numeric parts of keys to the end,
+// so a row is only safe as a prefix when its sample key starts with it
+func (i *Idler) planPrefix(v *Result) (prefix string, ok bool) {
+	prefix = v.prefix + i.separator
+	ok = strings.HasPrefix(v.sample, prefix)
+	return
+}
+
+func (i *Idler) savePlan(results []*Result, filter *common.Filter) (err error) {
+	writer, err := common.NewPlanWriter(i.plan.File, "idler", i.client)
+
+	if err != nil {
+		return
+	}
+
+	if i.plan.Keys {
+		for _, key := range i.plan.keys {
+			if !filter.MatchKey(key.Key, key.kind) {
+				continue
+			}
+
+			if err = writer.Write(&key.PlanEntry); err != nil {
+				writer.Close()
+				return
+			}
+		}
+
+		return writer.Close()
+	}
+
+	var skipped int
+
+	for _, v := range results {
+		// expirer only sets the ttl of persistent keys, rows of keys which already expire are useless
+		if v.ttl >= 0 {
+			continue
+		}
+
+		prefix, ok := i.planPrefix(v)
+
+		if !ok {
+			skipped++
+			continue
+		}
+
+		for _, item := range strings.Split(v.db, ",") {
+			db, _ := strconv.Atoi(item)
+
+			if err = writer.Write(&common.PlanEntry{DB: db, Action: common.PlanExpire, Prefix: prefix, TTL: i.idles[0]}); err != nil {
+				writer.Close()
+				return
+			}
+		}
+	}
+
+	if skipped > 0 {
+		log.Printf("Warning: %d rows are not written to the plan, their prefixes have numeric parts, use exact keys instead", skipped)
+	}
+
+	return writer.Close()
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/marsmay/golib/math2"
+)
+
+// values larger than this are truncated before measuring the compression ratio, and the sizes are scaled by STRLEN
+const CompressSampleSize = 1 << 20
+
+// EncodeAll of a zstd encoder is safe for concurrent use
+var zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+
+var magics = []struct {
+	format string
+	magic  []byte
+}{
+	{"gzip", []byte{0x1f, 0x8b}},
+	{"zstd", []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{"lz4", []byte{0x04, 0x22, 0x4d, 0x18}},
+	{"snappy", []byte("\xff\x06\x00\x00sNaPpY")},
+}
+
+type Compress struct {
+	mix         string
+	gzipRatio   float64
+	snappyRatio float64
+	zstdRatio   float64
+	saving      int64
+}
+
+// detectFormat detects the format of the value, truncated values are only checked by the prefix
+func detectFormat(value []byte, truncated bool) string {
+	if len(value) == 0 {
+		return "empty"
+	}
+
+	for _, m := range magics {
+		if bytes.HasPrefix(value, m.magic) {
+			return m.format
+		}
+	}
+
+	if _, err := strconv.ParseInt(string(value), 10, 64); err == nil {
+		return "integer"
+	}
+
+	if utf8.Valid(value) {
+		if trimmed := bytes.TrimSpace(value); len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') && json.Valid(trimmed) {
+			return "json"
+		}
+
+		return "text"
+	}
+
+	switch b := value[0]; {
+	case b >= 0x80 && b <= 0x9f, b == 0xdc, b == 0xdd, b == 0xde, b == 0xdf:
+		// fixmap, fixarray, array16/32, map16/32
+		return "msgpack"
+	}
+
+	if isProtobuf(value, truncated) {
+		return "protobuf"
+	}
+
+	return "binary"
+}
+
+func readVarint(value []byte) (v uint64, n int) {
+	for shift := uint(0); n < len(value) && n < 10; shift += 7 {
+		b := value[n]
+		n++
+		v |= uint64(b&0x7f) << shift
+
+		if b < 0x80 {
+			return
+		}
+	}
+
+	return 0, 0
+}
+
+// isProtobuf checks the whole value parses as protobuf fields with valid wire types and lengths
+func isProtobuf(value []byte, truncated bool) bool {
+	fields := 0
+
+	for len(value) > 0 {
+		tag, n := readVarint(value)
+
+		if n == 0 {
+			return truncated && fields > 0
+		}
+
+		// field numbers are 1 to 2^29-1
+		if field := tag >> 3; field == 0 || field >= 1<<29 {
+			return false
+		}
+
+		value = value[n:]
+		size := 0
+
+		switch tag & 0x07 {
+		case 0:
+			if _, size = readVarint(value); size == 0 {
+				return truncated && fields > 0
+			}
+		case 1:
+			size = 8
+		case 2:
+			length, n := readVarint(value)
+
+			if n == 0 {
+				return truncated && fields > 0
+			}
+
+			if length > uint64(len(value)-n) {
+				return truncated && fields > 0
+			}
+
+			size = n + int(length)
+		case 5:
+			size = 4
+		default:
+			return false
+		}
+
+		if size > len(value) {
+			return truncated && fields > 0
+		}
+
+		value = value[size:]
+		fields++
+	}
+
+	return fields > 0
+}
+
+func isIncompressible(format string) bool {
+	switch format {
+	case "gzip", "zstd", "lz4", "snappy", "integer", "empty":
+		return true
+	}
+
+	return false
+}
+
+func gzipSize(value []byte) int64 {
+	var buf bytes.Buffer
+
+	writer := gzip.NewWriter(&buf)
+	_, _ = writer.Write(value)
+	_ = writer.Close()
+
+	return int64(buf.Len())
+}
+
+// scaleSize scales the size measured on the sampled bytes to the full length of the value
+func scaleSize(size, sampled, length int64) int64 {
+	if sampled == length {
+		return size
+	}
+
+	return int64(float64(size) * float64(length) / float64(sampled))
+}
+
+func (p *Paser) getCompress(kind string, num int64, keys []string) (compress *Compress) {
+	compress = &Compress{}
+
+	if strings.ToLower(kind) != "string" {
+		return
+	}
+
+	var (
+		counts                                     = make(map[string]int64, 4)
+		sampled                                    int64
+		rawSize, gzipTotal, snappyTotal, zstdTotal int64
+	)
+
+	for _, sample := range keys {
+		client, key := p.lookup(sample)
+		value, err := client.GetRange(key, 0, CompressSampleSize-1).Bytes()
+
+		if err != nil {
+			log.Printf("Warning: get key value failed, '%s' %s", key, err)
+			continue
+		}
+
+		length := int64(len(value))
+		truncated := length == CompressSampleSize
+
+		// the ratio of the truncated bytes is applied to the full length
+		if truncated {
+			if length, err = client.StrLen(key).Result(); err != nil {
+				log.Printf("Warning: get key length failed, '%s' %s", key, err)
+				continue
+			}
+		}
+
+		format := detectFormat(value, truncated)
+		counts[format]++
+		sampled++
+
+		if isIncompressible(format) {
+			continue
+		}
+
+		size := int64(len(value))
+		rawSize += length
+		gzipTotal += scaleSize(gzipSize(value), size, length)
+		snappyTotal += scaleSize(int64(len(snappy.Encode(nil, value))), size, length)
+		zstdTotal += scaleSize(int64(len(zstdEncoder.EncodeAll(value, nil))), size, length)
+	}
+
+	if sampled == 0 {
+		return
+	}
+
+	formats := make([]string, 0, len(counts))
+
+	for format := range counts {
+		formats = append(formats, format)
+	}
+
+	sort.Slice(formats, func(i, j int) bool {
+		return counts[formats[i]] > counts[formats[j]]
+	})
+
+	mixes := make([]string, 0, len(formats))
+
+	for _, format := range formats {
+		mixes = append(mixes, fmt.Sprintf("%s %.2f%%", format, math2.Percent[int64, float64](counts[format], sampled, 2)))
+	}
+
+	compress.mix = strings.Join(mixes, "|")
+
+	if rawSize == 0 {
+		return
+	}
+
+	compress.gzipRatio = float64(gzipTotal) / float64(rawSize)
+	compress.snappyRatio = float64(snappyTotal) / float64(rawSize)
+	compress.zstdRatio = float64(zstdTotal) / float64(rawSize)
+
+	// estimate with the best algorithm, keys already compressed save nothing
+	if saved := rawSize - math2.Min(gzipTotal, math2.Min(snappyTotal, zstdTotal)); saved > 0 {
+		compress.saving = num * saved / sampled
+	}
+
+	return
+}
+
+func formatRatio(ratio float64) string {
+	if ratio == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("%.2f", ratio)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDetectFormat(t *testing.T) {
+	tests := []struct {
+		value     string
+		truncated bool
+		format    string
+	}{
+		{"", false, "empty"},
+		{"\x1f\x8b\x08\x00", false, "gzip"},
+		{"\x28\xb5\x2f\xfd\x00", false, "zstd"},
+		{"\x04\x22\x4d\x18\x00", false, "lz4"},
+		{"\xff\x06\x00\x00sNaPpY", false, "snappy"},
+		{"12345", false, "integer"},
+		{"-12", false, "integer"},
+		{`{"a": 1}`, false, "json"},
+		{" [1, 2] ", false, "json"},
+		{"{abc", false, "text"},
+		{"hello", false, "text"},
+		{"\x81\xa1a\x01", false, "msgpack"},
+		{"\xdc\x00\x01\x01", false, "msgpack"},
+		// field 1 varint 150, field 2 bytes abc
+		{"\x08\x96\x01\x12\x03abc", false, "protobuf"},
+		// the length of field 2 runs past the end, which is only accepted for truncated values
+		{"\x08\x01\x12\x90\x4ex", false, "binary"},
+		{"\x08\x01\x12\x90\x4ex", true, "protobuf"},
+		// wire type 7 is invalid
+		{"\xff\x00\x13", false, "binary"},
+		// field number 0 is invalid
+		{"\x02\x01\xfe", false, "binary"},
+	}
+
+	for _, test := range tests {
+		if format := detectFormat([]byte(test.value), test.truncated); format != test.format {
+			t.Errorf("format of %q is %s, wanted %s", test.value, format, test.format)
+		}
+	}
+}
+
+func TestIsProtobuf(t *testing.T) {
+	tests := []struct {
+		value     string
+		truncated bool
+		ok        bool
+	}{
+		// fixed64 and fixed32 fields
+		{"\x09\x01\x02\x03\x04\x05\x06\x07\x08\x15\x01\x02\x03\x04", false, true},
+		{"\x09\x01\x02\x03", false, false},
+		{"\x09\x01\x02\x03", true, false},
+		// a varint without its end
+		{"\x08\x96", false, false},
+		// groups of wire types 3 and 4 are deprecated
+		{"\x0b\x0c", false, false},
+	}
+
+	for _, test := range tests {
+		if ok := isProtobuf([]byte(test.value), test.truncated); ok != test.ok {
+			t.Errorf("protobuf of %q is %v, wanted %v", test.value, ok, test.ok)
+		}
+	}
+}
+
+func TestScaleSize(t *testing.T) {
+	if size := scaleSize(100, 1000, 1000); size != 100 {
+		t.Errorf("size of a whole value is scaled to %d", size)
+	}
+
+	if size := scaleSize(100, CompressSampleSize, 4*CompressSampleSize); size != 400 {
+		t.Errorf("size of a truncated value is scaled to %d, wanted 400", size)
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/bits"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis"
+	"github.com/marsmay/golib/math2"
+	"github.com/marsmay/golib/strings2"
+)
+
+// compact encodings are only recommended up to these limits, larger listpacks make every access O(n)
+const CompactMaxEntries = 1024
+const CompactMaxValue = 1024
+
+type CompactRule struct {
+	full     string   // encoding used when the compact limits are exceeded
+	entries  []string // config names of the entries limit, newest first
+	values   []string // config names of the value size limit, newest first
+	keyCost  int64    // estimated bytes saved per key by the compact encoding
+	itemCost int64    // estimated bytes saved per item by the compact encoding
+}
+
+var compactRules = map[string]*CompactRule{
+	"hash": {
+		full:     "hashtable",
+		entries:  []string{"hash-max-listpack-entries", "hash-max-ziplist-entries"},
+		values:   []string{"hash-max-listpack-value", "hash-max-ziplist-value"},
+		keyCost:  64,
+		itemCost: 60,
+	},
+	"zset": {
+		full:     "skiplist",
+		entries:  []string{"zset-max-listpack-entries", "zset-max-ziplist-entries"},
+		values:   []string{"zset-max-listpack-value", "zset-max-ziplist-value"},
+		keyCost:  96,
+		itemCost: 84,
+	},
+	"set": {
+		full:     "hashtable",
+		entries:  []string{"set-max-listpack-entries", "set-max-intset-entries"},
+		values:   []string{"set-max-listpack-value"},
+		keyCost:  64,
+		itemCost: 38,
+	},
+	"list": {
+		full:     "quicklist",
+		entries:  []string{"list-max-listpack-size", "list-max-ziplist-size"},
+		keyCost:  72,
+		itemCost: 0,
+	},
+}
+
+type Advice struct {
+	param   string
+	current int64
+	value   int64
+}
+
+type Encoding struct {
+	mix     string
+	advices []*Advice
+	saving  int64
+}
+
+// getConfig loads the compact encoding limits of the server, return nil if CONFIG is not allowed
+func (p *Paser) getConfig() map[string]int64 {
+	config := make(map[string]int64, 16)
+
+	for _, pattern := range []string{"hash-max-*", "set-max-*", "zset-max-*", "list-max-*"} {
+		values, err := p.client.ConfigGet(pattern).Result()
+
+		if err != nil {
+			log.Printf("Warning: get config failed, '%s' %s", pattern, err)
+			return nil
+		}
+
+		for i := 0; i < len(values)-1; i += 2 {
+			name, _ := values[i].(string)
+			value, _ := values[i+1].(string)
+
+			if n, e := strconv.ParseInt(value, 10, 64); e == nil {
+				config[name] = n
+			}
+		}
+	}
+
+	return config
+}
+
+func (p *Paser) getItems(client *redis.Client, kind, key string) (length int64, items []string, err error) {
+	switch kind {
+	case "list":
+		if length, err = client.LLen(key).Result(); err == nil {
+			items, err = client.LRange(key, 0, LenSampleNum).Result()
+		}
+	case "set":
+		if length, err = client.SCard(key).Result(); err == nil {
+			items, err = client.SRandMemberN(key, LenSampleNum).Result()
+		}
+	case "zset":
+		if length, err = client.ZCard(key).Result(); err == nil {
+			items, err = client.ZRange(key, 0, LenSampleNum).Result()
+		}
+	case "hash":
+		if length, err = client.HLen(key).Result(); err == nil {
+			var values []string
+
+			if values, _, err = client.HScan(key, 0, "*", LenSampleNum).Result(); err == nil {
+				for i := 0; i < len(values)-1; i += 2 {
+					items = append(items, values[i], values[i+1])
+				}
+			}
+		}
+	}
+
+	return
+}
+
+func (p *Paser) getEncoding(kind string, num int64, keys []string) (encoding *Encoding) {
+	kind = strings.ToLower(kind)
+	encoding = &Encoding{}
+
+	var (
+		counts      = make(map[string]int64, 4)
+		candidates  []int64
+		maxEntries  int64
+		maxValue    int64
+		allIntegers = true
+		sampled     int64
+	)
+
+	rule := compactRules[kind]
+
+	for _, sample := range keys {
+		client, key := p.lookup(sample)
+		name, err := client.ObjectEncoding(key).Result()
+
+		if err != nil {
+			log.Printf("Warning: get key encoding failed, '%s' %s", key, err)
+			continue
+		}
+
+		counts[name]++
+		sampled++
+
+		if rule == nil || name != rule.full {
+			continue
+		}
+
+		length, items, err := p.getItems(client, kind, key)
+
+		if err != nil {
+			log.Printf("Warning: get key items failed, '%s' %s", key, err)
+			continue
+		}
+
+		var itemSize int64
+
+		for _, item := range items {
+			itemSize = math2.Max(itemSize, int64(len(item)))
+			allIntegers = allIntegers && strings2.IsNum(item)
+		}
+
+		if kind == "list" {
+			// list limit is a byte size per node when negative, only entries are checked here
+			itemSize = 0
+		}
+
+		if length > CompactMaxEntries || itemSize > CompactMaxValue {
+			continue
+		}
+
+		candidates = append(candidates, length)
+		maxEntries = math2.Max(maxEntries, length)
+		maxValue = math2.Max(maxValue, itemSize)
+	}
+
+	if sampled == 0 {
+		return
+	}
+
+	names := make([]string, 0, len(counts))
+
+	for name := range counts {
+		names = append(names, name)
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		return counts[names[i]] > counts[names[j]]
+	})
+
+	mixes := make([]string, 0, len(names))
+
+	for _, name := range names {
+		mixes = append(mixes, fmt.Sprintf("%s %.2f%%", name, math2.Percent[int64, float64](counts[name], sampled, 2)))
+	}
+
+	encoding.mix = strings.Join(mixes, "|")
+
+	if rule == nil || len(candidates) == 0 || p.config == nil {
+		return
+	}
+
+	entriesParam, entries := lookupConfig(p.config, rule.entries)
+
+	if entriesParam == "" || (strings.Contains(entriesParam, "intset") && !allIntegers) {
+		return
+	}
+
+	if entries < 0 {
+		// negative list size means the node is limited by bytes, not entries
+		return
+	}
+
+	if maxEntries > entries {
+		encoding.advices = append(encoding.advices, &Advice{param: entriesParam, current: entries, value: roundPow2(maxEntries)})
+	}
+
+	if valueParam, value := lookupConfig(p.config, rule.values); valueParam != "" && maxValue > value {
+		encoding.advices = append(encoding.advices, &Advice{param: valueParam, current: value, value: roundPow2(maxValue)})
+	}
+
+	if len(encoding.advices) == 0 {
+		return
+	}
+
+	convertNum := num * int64(len(candidates)) / sampled
+	encoding.saving = convertNum * (rule.keyCost + rule.itemCost*math2.AvgList(candidates))
+	return
+}
+
+func (p *Paser) printAdvices() {
+	if len(p.advices) == 0 {
+		return
+	}
+
+	params := make([]string, 0, len(p.advices))
+
+	for param := range p.advices {
+		params = append(params, param)
+	}
+
+	sort.Strings(params)
+
+	fmt.Fprintln(os.Stderr, "compact encoding advices:")
+
+	for _, param := range params {
+		advice := p.advices[param]
+		fmt.Fprintf(os.Stderr, "  CONFIG SET %s %d (current %d)\n", advice.param, advice.value, advice.current)
+	}
+
+	fmt.Fprintf(os.Stderr, "  estimated saving: %d bytes\n", p.saving)
+}
+
+func (p *Paser) addAdvices(encoding *Encoding) {
+	for _, advice := range encoding.advices {
+		if exist := p.advices[advice.param]; exist == nil || exist.value < advice.value {
+			p.advices[advice.param] = advice
+		}
+	}
+
+	p.saving += encoding.saving
+}
+
+func lookupConfig(config map[string]int64, names []string) (name string, value int64) {
+	for _, name = range names {
+		if value, ok := config[name]; ok {
+			return name, value
+		}
+	}
+
+	return "", 0
+}
+
+func roundPow2(n int64) int64 {
+	if n <= 1 {
+		return 1
+	}
+
+	return 1 << bits.Len64(uint64(n-1))
+}
+
+func formatAdvices(advices []*Advice) string {
+	items := make([]string, 0, len(advices))
+
+	for _, advice := range advices {
+		items = append(items, fmt.Sprintf("%s %d -> %d", advice.param, advice.current, advice.value))
+	}
+
+	return strings.Join(items, "|")
+}
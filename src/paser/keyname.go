@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/marsmay/golib/math2"
+	"github.com/marsmay/redis-tools/common"
+)
+
+// values up to this size fit the default hash-max-listpack-value, so they can be bucketed into hashes
+const BucketMaxValue = 64
+
+// listpack entry headers of a field and a value
+const BucketItemCost = 4
+
+type KeyName struct {
+	avgLen   int64
+	totalLen int64
+	overhead int64
+	saving   int64
+}
+
+func (p *Paser) getKeyName(v *Result, itemSize int64) (keyName *KeyName) {
+	keyName = &KeyName{totalLen: v.keyLen}
+
+	if v.num == 0 {
+		return
+	}
+
+	keyName.avgLen = v.keyLen / v.num
+	// dictEntry of the main dict, the value object and the sds header and allocation padding of the key name
+	keyName.overhead = common.MallocSize(common.DictEntrySize) + common.SdsSize(keyName.avgLen) - keyName.avgLen
+	isString := strings.ToLower(v.kind) == "string"
+
+	// the object of an embstr value shares the allocation of the value
+	if !isString || itemSize > common.EmbstrMaxLen {
+		keyName.overhead += common.MallocSize(common.RobjSize)
+	}
+
+	// hash fields only expire by HEXPIRE of redis 7.4+, which converts the listpack to a larger one, so only persistent
+	// small strings are bucketed
+	persistNum := v.num - v.expireNum
+
+	if !isString || persistNum <= 0 || itemSize > BucketMaxValue {
+		return
+	}
+
+	fieldLen := math2.Max(1, keyName.avgLen-int64(len(v.prefix)))
+	current := common.MallocSize(common.DictEntrySize) + common.SdsSize(keyName.avgLen) + common.StringSize(itemSize)
+	bucketed := fieldLen + itemSize + BucketItemCost
+
+	if current > bucketed {
+		keyName.saving = persistNum * (current - bucketed)
+	}
+
+	return
+}
@@ -7,6 +7,10 @@ import (
 	"fmt"
 	"log"
 	"runtime"
+	"time"
+
+	"github.com/marsmay/golib/flag2"
+	"github.com/marsmay/redis-tools/common"
 )
 
 var (
@@ -14,8 +18,19 @@ var (
 	separator string
 	keysLen   int
 	mergeLen  int
+	sampleNum int64
 	noExpire  bool
+	format    string
 	output    string
+	allDB     bool
+	mergeDB   bool
+	replica   bool
+	interval  time.Duration
+	listen    string
+	sortBy    string
+	top       int
+	filter    = &common.Filter{}
+	forecast  = &Forecast{}
 
 	buildTime string
 	gitHash   string
@@ -29,8 +44,26 @@ func init() {
 	flag.StringVar(&separator, "s", "", "")
 	flag.IntVar(&keysLen, "sn", 100, "")
 	flag.IntVar(&mergeLen, "mn", 20, "")
+	flag.Int64Var(&sampleNum, "rn", 0, "")
 	flag.BoolVar(&noExpire, "n", false, "")
+	flag.StringVar(&format, "f", "csv", "")
 	flag.StringVar(&output, "o", "./", "")
+	flag.BoolVar(&allDB, "all-db", false, "")
+	flag.BoolVar(&mergeDB, "merge-db", false, "")
+	flag.BoolVar(&replica, "replica", false, "")
+	flag.DurationVar(&interval, "d", 0, "")
+	flag.StringVar(&listen, "l", "", "")
+	flag.StringVar(&sortBy, "sort", "size", "")
+	flag.IntVar(&top, "top", 0, "")
+	flag.Int64Var(&filter.MinNum, "min-num", 0, "")
+	flag.Int64Var(&filter.MinSize, "min-size", 0, "")
+	flag.Var((*flag2.Strings)(&filter.Kinds), "type", "")
+	flag.Var((*flag2.Strings)(&filter.Includes), "include", "")
+	flag.Var((*flag2.Strings)(&filter.Excludes), "exclude", "")
+	flag.IntVar(&forecast.Hours, "ttl-hours", 0, "")
+	flag.Int64Var(&forecast.Window, "ttl-window", 60, "")
+	flag.Float64Var(&forecast.SpikeRatio, "ttl-spike", 0.1, "")
+	flag.Int64Var(&forecast.SpikeMin, "ttl-spike-min", 100, "")
 
 	flag.Usage = func() {
 		fmt.Printf(usage, gitHash, buildTime)
@@ -41,7 +74,13 @@ func main() {
 	// parse flag
 	flag.Parse()
 
-	if separator == "" || keysLen <= 0 || mergeLen <= 0 || output == "" {
+	if separator == "" || keysLen <= 0 || mergeLen <= 0 || sampleNum < 0 || format == "" || output == "" || interval < 0 || (listen != "" && interval == 0) || !validSort(sortBy) || top < 0 || forecast.Hours < 0 || forecast.Window <= 0 || forecast.SpikeRatio <= 0 || forecast.SpikeMin < 0 {
+		flag.Usage()
+		return
+	}
+
+	// the forecast writes two more reports, which can't follow the keys report on stdout
+	if output == common.Stdout && forecast.Hours > 0 {
 		flag.Usage()
 		return
 	}
@@ -49,24 +88,67 @@ func main() {
 	// set max cpu core
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
+	// serve metrics
+	if listen != "" {
+		format, output = "prom", common.Metrics
+		common.ServeMetrics(listen)
+	}
+
+	for {
+		err := run()
+
+		if interval <= 0 {
+			if err != nil {
+				log.Fatalf("Fatal Error: %s", err)
+			}
+
+			break
+		}
+
+		if err != nil {
+			log.Printf("Warning: %s", err)
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+func run() (err error) {
 	// init paser
-	paser, err := NewPaser(redisUrl, separator, keysLen, mergeLen, output)
+	paser, err := NewPaser(redisUrl, separator, keysLen, mergeLen, sampleNum, format, output, allDB, mergeDB, replica)
 
 	if err != nil {
-		log.Fatalf("Fatal Error: init paser failed, redis url '%s', output '%s', %s", redisUrl, output, err)
+		return fmt.Errorf("init paser failed, redis url '%s', output '%s', %s", redisUrl, output, err)
 	}
 
+	defer paser.Close()
+
 	// do parse
-	err = paser.Run(noExpire)
+	if forecast.Hours > 0 {
+		err = paser.Run(noExpire, forecast)
+	} else {
+		err = paser.Run(noExpire, nil)
+	}
 
 	if err != nil {
-		log.Fatalf("Fatal Error: parse item data failed, %s", err)
+		return fmt.Errorf("parse item data failed, %s", err)
 	}
 
 	// save report
-	err = paser.Save()
+	err = paser.Save(filter, sortBy, top)
 
 	if err != nil {
-		log.Fatalf("Fatal Error: save report failed, %s", err)
+		return fmt.Errorf("save report failed, %s", err)
 	}
+
+	return
+}
+
+func validSort(sortBy string) bool {
+	switch sortBy {
+	case "size", "num", "ttl":
+		return true
+	}
+
+	return false
 }
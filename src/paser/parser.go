@@ -3,13 +3,13 @@ package main
 import (
 	"fmt"
 	"log"
-	"path"
+	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/go-redis/redis"
-	"github.com/marsmay/golib/csv"
 	"github.com/marsmay/golib/math2"
 	"github.com/marsmay/redis-tools/common"
 )
@@ -18,44 +18,125 @@ const BarWidth = 64
 const ScanBatchNum = 500
 const LenSampleNum = 10
 
+// tree index of all databases in merged mode
+const MergedDB = -1
+
 type Result struct {
-	prefix string
-	kind   string
-	num    int64
-	keys   []string
-	ttl    int64
-	sample string
+	db        string
+	prefix    string
+	kind      string
+	num       int64
+	numLow    int64
+	numHigh   int64
+	keys      []string
+	ttl       int64
+	keyLen    int64
+	expireNum int64
+	sample    string
+	size      int64
+	expires   map[int64]int64
+	line      []string
 }
 
 type Paser struct {
 	client    *redis.Client
-	reporter  *csv.Writer
+	master    *redis.Client
+	clients   map[int]*redis.Client
+	dbs       []int
+	allDB     bool
+	mergeDB   bool
+	reporter  common.Reporter
+	format    string
+	output    string
+	instance  string
+	forecast  *Forecast
 	separator string
-	tree      *common.Tree
+	keysLen   int
+	mergeLen  int
+	sampleNum int64
+	sampled   map[int]int64
+	totals    map[int]int64
+	trees     map[int]*common.Tree
 	results   []*Result
+	config    map[string]int64
+	advices   map[string]*Advice
+	saving    int64
+}
+
+func (p *Paser) lookup(sample string) (client *redis.Client, key string) {
+	if !p.allDB {
+		return p.client, sample
+	}
+
+	db, key := common.UntagKey(sample)
+	return p.clients[db], key
+}
+
+func (p *Paser) getTree(db int) *common.Tree {
+	if p.mergeDB {
+		db = MergedDB
+	}
+
+	if p.trees[db] == nil {
+		p.trees[db] = common.NewTree(p.separator, p.keysLen, p.mergeLen, func(node *common.Node, data map[string]int64) {
+			node.Data["ttl"] += data["ttl"]
+			node.Data["key_len"] += data["key_len"]
+
+			if data["ttl"] > 0 {
+				node.Data["expire_num"]++
+			}
+
+			if p.forecast != nil && data["expire_at"] > 0 {
+				if bucket, ok := p.forecast.bucket(data["expire_at"]); ok {
+					node.Data[ExpirePrefix+strconv.FormatInt(bucket, 10)]++
+				}
+			}
+
+			if p.mergeDB {
+				node.Data["db"+strconv.FormatInt(data["db"], 10)]++
+			}
+		})
+	}
+
+	return p.trees[db]
 }
 
-func (p *Paser) calcNode(node *common.Node, name string) {
+func (p *Paser) calcNode(node *common.Node, name string, db int) {
 	if node.Childrens == nil {
 		result := &Result{
-			prefix: name,
-			kind:   node.Kind,
-			num:    node.Num,
-			keys:   node.Keys,
+			db:        strconv.Itoa(db),
+			prefix:    name,
+			kind:      node.Kind,
+			num:       node.Num,
+			keys:      node.Keys,
+			keyLen:    node.Data["key_len"],
+			expireNum: node.Data["expire_num"],
 		}
 
 		if node.Num > 0 {
 			result.ttl = node.Data["ttl"] / node.Num
 		}
 
+		if db == MergedDB {
+			result.db = common.FormatDBs(node.Data)
+		}
+
+		if p.forecast != nil {
+			result.expires = parseExpires(node.Data)
+		}
+
+		if p.sampleNum > 0 {
+			p.scaleResult(result, node, db)
+		}
+
 		if len(node.Keys) > 0 {
-			result.sample = node.Keys[0]
+			_, result.sample = p.lookup(node.Keys[0])
 		}
 
 		p.results = append(p.results, result)
 	} else {
 		for _, v := range node.Childrens {
-			p.calcNode(v, name+p.separator+v.Name)
+			p.calcNode(v, name+p.separator+v.Name, db)
 		}
 	}
 }
@@ -63,8 +144,9 @@ func (p *Paser) calcNode(node *common.Node, name string) {
 func (p *Paser) getStrInfo(keys []string) (itemNum, itemSize int64) {
 	itemNums := make([]int64, 0, len(keys))
 
-	for _, key := range keys {
-		length, err := p.client.StrLen(key).Result()
+	for _, sample := range keys {
+		client, key := p.lookup(sample)
+		length, err := client.StrLen(key).Result()
 
 		if err != nil {
 			log.Printf("Warning: get key length failed, '%s' %s", key, err)
@@ -87,8 +169,9 @@ func (p *Paser) getListInfo(keys []string) (itemNum, itemSize int64) {
 	itemNums := make([]int64, 0, len(keys))
 	itemSizes := make([]int64, 0, len(keys))
 
-	for _, key := range keys {
-		length, err := p.client.LLen(key).Result()
+	for _, sample := range keys {
+		client, key := p.lookup(sample)
+		length, err := client.LLen(key).Result()
 
 		if err != nil {
 			log.Printf("Warning: get list length failed, '%s' %s", key, err)
@@ -101,7 +184,7 @@ func (p *Paser) getListInfo(keys []string) (itemNum, itemSize int64) {
 
 		itemNums = append(itemNums, length)
 
-		items, err := p.client.LRange(key, 0, LenSampleNum).Result()
+		items, err := client.LRange(key, 0, LenSampleNum).Result()
 
 		if err != nil {
 			log.Printf("Warning: get list items failed, '%s' %s", key, err)
@@ -122,8 +205,9 @@ func (p *Paser) getSetInfo(keys []string) (itemNum, itemSize int64) {
 	itemNums := make([]int64, 0, len(keys))
 	itemSizes := make([]int64, 0, len(keys))
 
-	for _, key := range keys {
-		length, err := p.client.SCard(key).Result()
+	for _, sample := range keys {
+		client, key := p.lookup(sample)
+		length, err := client.SCard(key).Result()
 
 		if err != nil {
 			log.Printf("Warning: get set length failed, '%s' %s", key, err)
@@ -136,7 +220,7 @@ func (p *Paser) getSetInfo(keys []string) (itemNum, itemSize int64) {
 
 		itemNums = append(itemNums, length)
 
-		items, err := p.client.SRandMemberN(key, LenSampleNum).Result()
+		items, err := client.SRandMemberN(key, LenSampleNum).Result()
 
 		if err != nil {
 			log.Printf("Warning: get set items failed, '%s' %s", key, err)
@@ -157,8 +241,9 @@ func (p *Paser) getZSetInfo(keys []string) (itemNum, itemSize int64) {
 	itemNums := make([]int64, 0, len(keys))
 	itemSizes := make([]int64, 0, len(keys))
 
-	for _, key := range keys {
-		length, err := p.client.ZCard(key).Result()
+	for _, sample := range keys {
+		client, key := p.lookup(sample)
+		length, err := client.ZCard(key).Result()
 
 		if err != nil {
 			log.Printf("Warning: get zset length failed, '%s' %s", key, err)
@@ -171,7 +256,7 @@ func (p *Paser) getZSetInfo(keys []string) (itemNum, itemSize int64) {
 
 		itemNums = append(itemNums, length)
 
-		items, err := p.client.ZRange(key, 0, LenSampleNum).Result()
+		items, err := client.ZRange(key, 0, LenSampleNum).Result()
 
 		if err != nil {
 			log.Printf("Warning: get zset items failed, '%s' %s", key, err)
@@ -192,8 +277,9 @@ func (p *Paser) getHashInfo(keys []string) (itemNum, itemSize int64) {
 	itemNums := make([]int64, 0, len(keys))
 	itemSizes := make([]int64, 0, len(keys))
 
-	for _, key := range keys {
-		length, err := p.client.HLen(key).Result()
+	for _, sample := range keys {
+		client, key := p.lookup(sample)
+		length, err := client.HLen(key).Result()
 
 		if err != nil {
 			log.Printf("Warning: get zset length failed, '%s' %s", key, err)
@@ -213,7 +299,7 @@ func (p *Paser) getHashInfo(keys []string) (itemNum, itemSize int64) {
 		)
 
 		for {
-			values, cursor, err = p.client.HScan(key, cursor, "*", LenSampleNum).Result()
+			values, cursor, err = client.HScan(key, cursor, "*", LenSampleNum).Result()
 
 			if err != nil {
 				log.Printf("Warning: get hash items failed, '%s' %s", key, err)
@@ -255,8 +341,45 @@ func (p *Paser) getLength(kind string, keys []string) (itemNum, itemSize int64)
 	return
 }
 
-func (p *Paser) Run(noExpire bool) (err error) {
-	total, err := p.client.DBSize().Result()
+func (p *Paser) addKey(client *redis.Client, tree *common.Tree, db int, key string, noExpire bool) (err error) {
+	kind, err := client.Type(key).Result()
+
+	if err != nil || kind == "none" {
+		return
+	}
+
+	ttl, err := client.TTL(key).Result()
+
+	if err != nil {
+		return
+	}
+
+	if !noExpire || ttl == -time.Second {
+		sample := key
+
+		if p.allDB {
+			sample = common.TagKey(db, key)
+		}
+
+		data := map[string]int64{
+			"ttl":     ttl.Milliseconds() / 1e3,
+			"key_len": int64(len(key)),
+			"db":      int64(db),
+		}
+
+		if ttl > 0 {
+			data["expire_at"] = time.Now().Add(ttl).Unix()
+		}
+
+		tree.AddSample(key, sample, kind, data)
+	}
+
+	return
+}
+
+func (p *Paser) scan(db int, noExpire bool) (err error) {
+	client, tree := p.clients[db], p.getTree(db)
+	total, err := client.DBSize().Result()
 
 	if err != nil {
 		return
@@ -269,41 +392,24 @@ func (p *Paser) Run(noExpire bool) (err error) {
 	)
 
 	for {
-		keys, cursor, err = p.client.Scan(cursor, "*", ScanBatchNum).Result()
+		keys, cursor, err = client.Scan(cursor, "*", ScanBatchNum).Result()
 
 		if err != nil {
 			return
 		}
 
 		if len(keys) > 0 {
-			var (
-				kind string
-				ttl  time.Duration
-			)
-
 			for _, key := range keys {
-				kind, err = p.client.Type(key).Result()
-
-				if err != nil {
-					return
-				}
-
-				ttl, err = p.client.TTL(key).Result()
+				err = p.addKey(client, tree, db, key, noExpire)
 
 				if err != nil {
 					return
 				}
 
-				if !noExpire || ttl == -time.Second {
-					p.tree.AddNode(key, kind, map[string]int64{
-						"ttl": ttl.Milliseconds() / 1e3,
-					})
-				}
-
 				processed++
 			}
 
-			common.ProgressBar(BarWidth, processed, total, "scan keys ...")
+			common.ProgressBar(BarWidth, processed, total, fmt.Sprintf("scan db%d keys ...", db))
 		}
 
 		if cursor == 0 {
@@ -311,67 +417,329 @@ func (p *Paser) Run(noExpire bool) (err error) {
 		}
 	}
 
-	fmt.Println()
+	fmt.Fprintln(os.Stderr)
 	return
 }
 
-func (p *Paser) Save() (err error) {
-	for _, node := range p.tree.Nodes {
-		p.calcNode(node, node.Name)
-	}
-
-	err = p.reporter.WriteLine([]string{"prefix", "type", "num", "avg item num", "avg item size", "total item num", "total item size", "avg ttl", "sample"})
+func (p *Paser) sample(db int, noExpire bool) (err error) {
+	client, tree := p.clients[db], p.getTree(db)
+	total, err := client.DBSize().Result()
 
 	if err != nil {
 		return
 	}
 
+	p.totals[db] = total
+
+	var key string
+
+	for p.sampled[db] < p.sampleNum {
+		key, err = client.RandomKey().Result()
+
+		if err == redis.Nil {
+			err = nil
+			break
+		}
+
+		if err != nil {
+			return
+		}
+
+		err = p.addKey(client, tree, db, key, noExpire)
+
+		if err != nil {
+			return
+		}
+
+		p.sampled[db]++
+
+		if p.sampled[db]%ScanBatchNum == 0 || p.sampled[db] == p.sampleNum {
+			common.ProgressBar(BarWidth, p.sampled[db], p.sampleNum, fmt.Sprintf("sample db%d keys ...", db))
+		}
+	}
+
+	fmt.Fprintln(os.Stderr)
+	return
+}
+
+// scaleResult scales the sampled counts of a result to the database size
+func (p *Paser) scaleResult(result *Result, node *common.Node, db int) {
+	counts := map[int]int64{db: node.Num}
+
+	if db == MergedDB {
+		counts = common.DBCounts(node.Data)
+	}
+
+	var estimate, variance float64
+
+	for d, hit := range counts {
+		e, v := common.Estimate(hit, p.sampled[d], p.totals[d])
+		estimate += e
+		variance += v
+	}
+
+	if node.Num > 0 {
+		scale := estimate / float64(node.Num)
+		result.keyLen = int64(float64(result.keyLen) * scale)
+		result.expireNum = int64(float64(result.expireNum) * scale)
+
+		for bucket, num := range result.expires {
+			result.expires[bucket] = int64(float64(num) * scale)
+		}
+	}
+
+	result.num = int64(estimate)
+	result.numLow, result.numHigh = common.ConfidenceInterval(estimate, variance)
+}
+
+func (p *Paser) Run(noExpire bool, forecast *Forecast) (err error) {
+	if forecast != nil {
+		forecast.start = time.Now().Unix()
+		p.forecast = forecast
+	}
+
+	if p.master != nil {
+		common.LogReplicaLag(p.master, p.client, "start")
+		defer common.LogReplicaLag(p.master, p.client, "end")
+	}
+
+	if p.allDB {
+		p.dbs, err = common.KeyspaceDBs(p.client)
+
+		if err != nil {
+			return
+		}
+
+		p.clients = common.NewDBClients(p.client.Options(), p.dbs)
+	}
+
+	for _, db := range p.dbs {
+		if p.sampleNum > 0 {
+			err = p.sample(db, noExpire)
+		} else {
+			err = p.scan(db, noExpire)
+		}
+
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func sortResults(results []*Result, sortBy string) {
+	var value func(v *Result) int64
+
+	switch sortBy {
+	case "num":
+		value = func(v *Result) int64 { return v.num }
+	case "ttl":
+		value = func(v *Result) int64 { return v.ttl }
+	default:
+		value = func(v *Result) int64 { return v.size }
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		if vi, vj := value(results[i]), value(results[j]); vi != vj {
+			return vi > vj
+		}
+
+		return results[i].prefix < results[j].prefix
+	})
+}
+
+func (p *Paser) Save(filter *common.Filter, sortBy string, top int) (err error) {
+	dbs := p.dbs
+
+	if p.mergeDB {
+		dbs = []int{MergedDB}
+	}
+
+	for _, db := range dbs {
+		if tree := p.trees[db]; tree != nil {
+			for _, node := range tree.Nodes {
+				p.calcNode(node, node.Name, db)
+			}
+		}
+	}
+
+	p.config = p.getConfig()
+
+	header := []string{"db", "prefix", "type", "num"}
+
+	if p.sampleNum > 0 {
+		header = append(header, "num low", "num high")
+	}
+
+	header = append(header, "avg item num", "avg item size", "total item num", "total item size", "avg ttl", "encoding", "encoding advice", "encoding saving", "format", "gzip ratio", "snappy ratio", "zstd ratio", "compress saving", "avg key len", "total key bytes", "key overhead", "bucket saving", "sample")
+	results := make([]*Result, 0, len(p.results))
+
 	for _, v := range p.results {
+		if !filter.Match(v.prefix, v.kind, v.num) {
+			continue
+		}
+
 		itemNum, itemSize := p.getLength(v.kind, v.keys)
+		encoding := p.getEncoding(v.kind, v.num, v.keys)
+		p.addAdvices(encoding)
+		compress := p.getCompress(v.kind, v.num, v.keys)
+		keyName := p.getKeyName(v, itemSize)
 
-		err = p.reporter.WriteLine([]string{
+		line := []string{
+			v.db,
 			v.prefix,
 			v.kind,
 			strconv.FormatInt(v.num, 10),
+		}
+
+		if p.sampleNum > 0 {
+			line = append(line, strconv.FormatInt(v.numLow, 10), strconv.FormatInt(v.numHigh, 10))
+		}
+
+		line = append(line,
 			strconv.FormatInt(itemNum, 10),
 			strconv.FormatInt(itemSize, 10),
 			strconv.FormatInt(v.num*itemNum, 10),
 			strconv.FormatInt(v.num*itemNum*itemSize, 10),
 			strconv.FormatInt(v.ttl, 10),
+			encoding.mix,
+			formatAdvices(encoding.advices),
+			strconv.FormatInt(encoding.saving, 10),
+			compress.mix,
+			formatRatio(compress.gzipRatio),
+			formatRatio(compress.snappyRatio),
+			formatRatio(compress.zstdRatio),
+			strconv.FormatInt(compress.saving, 10),
+			strconv.FormatInt(keyName.avgLen, 10),
+			strconv.FormatInt(keyName.totalLen, 10),
+			strconv.FormatInt(keyName.overhead, 10),
+			strconv.FormatInt(keyName.saving, 10),
 			v.sample,
-		})
+		)
+
+		v.size, v.line = v.num*itemNum*itemSize, line
+
+		if filter.MatchSize(v.size) {
+			results = append(results, v)
+		}
+	}
+
+	sortResults(results, sortBy)
+
+	err = p.saveExpires(results)
+
+	if err != nil {
+		p.reporter.Close()
+		return
+	}
+
+	if top > 0 && len(results) > top {
+		results = results[:top]
+	}
+
+	err = p.reporter.WriteLine(header)
+
+	if err != nil {
+		p.reporter.Close()
+		return
+	}
+
+	for _, v := range results {
+		err = p.reporter.WriteLine(v.line)
 
 		if err != nil {
+			p.reporter.Close()
 			return
 		}
 	}
 
-	p.reporter.Close()
+	err = p.reporter.Close()
+	p.printAdvices()
 	return
 }
 
-func NewPaser(url string, separator string, keysLen, mergeLen int, output string) (paser *Paser, err error) {
+func (p *Paser) Close() {
+	for _, client := range p.clients {
+		if client != p.client {
+			client.Close()
+		}
+	}
+
+	if p.master != nil {
+		p.master.Close()
+	}
+
+	p.client.Close()
+}
+
+func NewPaser(url string, separator string, keysLen, mergeLen int, sampleNum int64, format, output string, allDB, mergeDB, replica bool) (paser *Paser, err error) {
 	options, err := redis.ParseURL(url)
 
 	if err != nil {
 		return
 	}
 
-	fileName := path.Join(output, fmt.Sprintf("keys-%s-%s.csv", options.Addr, time.Now().Format("20060102150405")))
-	reporter, err := csv.NewWriter(fileName)
+	// reports keep the name of the url instance
+	instance := options.Addr
+	var master *redis.Client
+
+	if replica {
+		options, master, err = common.UseReplica(options)
+
+		if err != nil {
+			return
+		}
+	}
+
+	// the length and value reads of the stat functions update the access time of keys
+	noTouch, version, err := common.NoTouch(options)
 
 	if err != nil {
+		if master != nil {
+			master.Close()
+		}
+
 		return
 	}
 
+	if !noTouch && !replica {
+		log.Printf("Warning: redis %s doesn't support CLIENT NO-TOUCH (7.2+), the analysis updates the access time of sampled keys, "+
+			"run it on a replica to keep the LRU/LFU data of the master", version)
+	}
+
+	reporter, err := common.NewReporter(format, output, "paser", "keys", instance)
+
+	if err != nil {
+		if master != nil {
+			master.Close()
+		}
+
+		return
+	}
+
+	client := redis.NewClient(options)
+
 	paser = &Paser{
-		client:    redis.NewClient(options),
+		client:    client,
+		master:    master,
+		clients:   map[int]*redis.Client{options.DB: client},
+		dbs:       []int{options.DB},
+		allDB:     allDB,
+		mergeDB:   allDB && mergeDB,
 		separator: separator,
 		reporter:  reporter,
-		tree: common.NewTree(separator, keysLen, mergeLen, func(node *common.Node, data map[string]int64) {
-			node.Data["ttl"] += data["ttl"]
-		}),
-		results: make([]*Result, 0, 256),
+		format:    format,
+		output:    output,
+		instance:  instance,
+		keysLen:   keysLen,
+		mergeLen:  mergeLen,
+		sampleNum: sampleNum,
+		sampled:   make(map[int]int64, 16),
+		totals:    make(map[int]int64, 16),
+		trees:     make(map[int]*common.Tree, 16),
+		results:   make([]*Result, 0, 256),
+		advices:   make(map[string]*Advice, 8),
 	}
 	return
 }
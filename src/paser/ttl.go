@@ -0,0 +1,226 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/marsmay/golib/math2"
+	"github.com/marsmay/redis-tools/common"
+)
+
+const ExpirePrefix = "expire:"
+
+const TimeLayout = "2006-01-02 15:04:05"
+
+type Forecast struct {
+	Hours      int
+	Window     int64
+	SpikeRatio float64
+	SpikeMin   int64
+	start      int64
+}
+
+type Spike struct {
+	result *Result
+	bucket int64
+	num    int64
+	share  float64
+}
+
+// bucket returns the window index of the expire time, windows beyond the forecast hours are ignored
+func (f *Forecast) bucket(expireAt int64) (bucket int64, ok bool) {
+	bucket = (expireAt - f.start) / f.Window
+	ok = bucket >= 0 && expireAt-f.start < int64(f.Hours)*3600
+	return
+}
+
+func (f *Forecast) windowTime(bucket int64) time.Time {
+	return time.Unix(f.start+bucket*f.Window, 0)
+}
+
+func parseExpires(data map[string]int64) map[int64]int64 {
+	expires := make(map[int64]int64, 16)
+
+	for name, num := range data {
+		if !strings.HasPrefix(name, ExpirePrefix) {
+			continue
+		}
+
+		if bucket, e := strconv.ParseInt(strings.TrimPrefix(name, ExpirePrefix), 10, 64); e == nil {
+			expires[bucket] = num
+		}
+	}
+
+	return expires
+}
+
+func (p *Paser) findSpikes(results []*Result) (spikes []*Spike) {
+	for _, v := range results {
+		if v.expireNum == 0 {
+			continue
+		}
+
+		for bucket, num := range v.expires {
+			share := float64(num) / float64(v.expireNum)
+
+			if num >= p.forecast.SpikeMin && share >= p.forecast.SpikeRatio {
+				spikes = append(spikes, &Spike{result: v, bucket: bucket, num: num, share: share})
+			}
+		}
+	}
+
+	sort.Slice(spikes, func(i, j int) bool {
+		if spikes[i].num != spikes[j].num {
+			return spikes[i].num > spikes[j].num
+		}
+
+		return spikes[i].bucket < spikes[j].bucket
+	})
+
+	return
+}
+
+func (p *Paser) newReporter(report string) (reporter common.Reporter, err error) {
+	return common.NewReporter(p.format, p.output, "paser", report, p.instance)
+}
+
+func (p *Paser) saveSpikes(results []*Result) (err error) {
+	reporter, err := p.newReporter("spikes")
+
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if e := reporter.Close(); err == nil {
+			err = e
+		}
+	}()
+
+	err = reporter.WriteLine([]string{"db", "prefix", "type", "window start", "window end", "expire num", "expire percent", "expire bytes"})
+
+	if err != nil {
+		return
+	}
+
+	for _, spike := range p.findSpikes(results) {
+		v := spike.result
+
+		err = reporter.WriteLine([]string{
+			v.db,
+			v.prefix,
+			v.kind,
+			p.forecast.windowTime(spike.bucket).Format(TimeLayout),
+			p.forecast.windowTime(spike.bucket + 1).Format(TimeLayout),
+			strconv.FormatInt(spike.num, 10),
+			strconv.FormatFloat(spike.share*100, 'f', 2, 64) + "%",
+			strconv.FormatInt(spike.num*keySize(v), 10),
+		})
+
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func (p *Paser) saveTimeline(results []*Result) (err error) {
+	reporter, err := p.newReporter("timeline")
+
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if e := reporter.Close(); err == nil {
+			err = e
+		}
+	}()
+
+	err = reporter.WriteLine([]string{"hour start", "hour end", "expire num", "expire bytes", "top prefix", "top prefix num"})
+
+	if err != nil {
+		return
+	}
+
+	var (
+		nums    = make([]int64, p.forecast.Hours)
+		sizes   = make([]int64, p.forecast.Hours)
+		tops    = make([]*Result, p.forecast.Hours)
+		topNums = make([]int64, p.forecast.Hours)
+	)
+
+	for _, v := range results {
+		hours := make([]int64, p.forecast.Hours)
+
+		for bucket, num := range v.expires {
+			hour := math2.Min(bucket*p.forecast.Window/3600, int64(p.forecast.Hours-1))
+			hours[hour] += num
+		}
+
+		for hour, num := range hours {
+			nums[hour] += num
+			sizes[hour] += num * keySize(v)
+
+			if num > topNums[hour] {
+				tops[hour], topNums[hour] = v, num
+			}
+		}
+	}
+
+	for hour := 0; hour < p.forecast.Hours; hour++ {
+		var top string
+
+		if tops[hour] != nil {
+			top = tops[hour].prefix
+		}
+
+		err = reporter.WriteLine([]string{
+			time.Unix(p.forecast.start+int64(hour)*3600, 0).Format(TimeLayout),
+			time.Unix(p.forecast.start+int64(hour+1)*3600, 0).Format(TimeLayout),
+			strconv.FormatInt(nums[hour], 10),
+			strconv.FormatInt(sizes[hour], 10),
+			top,
+			strconv.FormatInt(topNums[hour], 10),
+		})
+
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// saveExpires writes the expiry spikes and the forecast timeline, prom reports only have the keys report
+func (p *Paser) saveExpires(results []*Result) (err error) {
+	if p.forecast == nil {
+		return
+	}
+
+	if p.format == "prom" {
+		log.Printf("Warning: expiry forecast is not written in format 'prom'")
+		return
+	}
+
+	err = p.saveSpikes(results)
+
+	if err != nil {
+		return
+	}
+
+	return p.saveTimeline(results)
+}
+
+// keySize estimates the bytes freed when a key of the result expires
+func keySize(v *Result) int64 {
+	if v.num == 0 {
+		return 0
+	}
+
+	return v.size/v.num + v.keyLen/v.num
+}
@@ -7,10 +7,13 @@ import (
 	"fmt"
 	"log"
 	"runtime"
+	"time"
 
 	"github.com/go-redis/redis"
 	"github.com/marsmay/golib/flag2"
+	"github.com/marsmay/golib/math2"
 	"github.com/marsmay/golib/strings2"
+	"github.com/marsmay/redis-tools/common"
 )
 
 const ScanBatchNum = 500
@@ -19,6 +22,7 @@ var (
 	redisUrl   string
 	keyPrefixs flag2.Strings
 	limit      int
+	planFile   string
 
 	buildTime string
 	gitHash   string
@@ -31,6 +35,7 @@ func init() {
 	flag.StringVar(&redisUrl, "u", "redis://127.0.0.1:6379/0", "")
 	flag.Var(&keyPrefixs, "p", "")
 	flag.IntVar(&limit, "l", 0, "")
+	flag.StringVar(&planFile, "plan", "", "")
 
 	flag.Usage = func() {
 		fmt.Printf(usage, gitHash, buildTime)
@@ -41,7 +46,7 @@ func main() {
 	// parse flag
 	flag.Parse()
 
-	if len(keyPrefixs) == 0 || limit < 0 {
+	if (len(keyPrefixs) == 0 && planFile == "") || limit < 0 {
 		flag.Usage()
 		return
 	}
@@ -58,12 +63,42 @@ func main() {
 
 	client := redis.NewClient(options)
 
+	// process plan
+	var processed int
+
+	if planFile != "" {
+		entries, err := common.ReadPlan(planFile, client)
+
+		if err != nil {
+			log.Fatalf("Fatal Error: read plan failed, file '%s', %s", planFile, err)
+		}
+
+		// only exact keys are deleted, prefixes and ttls of a plan are for redis-expirer
+		for _, entry := range entries {
+			if entry.Action != common.PlanDelete || entry.Key == "" {
+				log.Fatalf("Fatal Error: plan entry '%s%s' is not a delete action of a key, write the plan by redis-idler -plan-keys -plan-action delete",
+					entry.Key, entry.Prefix)
+			}
+		}
+
+		for start := 0; start < len(entries); start += ScanBatchNum {
+			processed += removeIdleKeys(client, entries[start:math2.Min(start+ScanBatchNum, len(entries))])
+
+			if limit > 0 && processed > limit {
+				return
+			}
+		}
+
+		if len(keyPrefixs) == 0 {
+			return
+		}
+	}
+
 	// process data
 	var (
-		pattern   string
-		cursor    uint64
-		keys      []string
-		processed int
+		pattern string
+		cursor  uint64
+		keys    []string
 	)
 
 	if len(keyPrefixs) > 1 {
@@ -96,17 +131,7 @@ func main() {
 		}
 
 		if len(delKeys) > 0 {
-			err = client.Del(delKeys...).Err()
-
-			if err != nil {
-				log.Fatalf("Fatal Error: delete keys failed, keys '%+v', %s", delKeys, err)
-			}
-
-			for _, key := range delKeys {
-				fmt.Println(key)
-			}
-
-			processed += len(delKeys)
+			processed += removeKeys(client, delKeys)
 		}
 
 		if cursor == 0 {
@@ -118,3 +143,65 @@ func main() {
 		}
 	}
 }
+
+// removeIdleKeys deletes the keys of plan entries whose idle time is still over the idle time of the plan,
+// keys accessed since the plan was written are kept
+func removeIdleKeys(client *redis.Client, entries []*common.PlanEntry) int {
+	cmds := make([]*redis.DurationCmd, len(entries))
+
+	client.Pipelined(func(pipe redis.Pipeliner) error {
+		for i, entry := range entries {
+			cmds[i] = pipe.ObjectIdleTime(entry.Key)
+		}
+
+		return nil
+	})
+
+	var (
+		keys = make([]string, 0, len(entries))
+		kept int
+	)
+
+	for i, entry := range entries {
+		idle, err := cmds[i].Result()
+
+		if err == redis.Nil {
+			continue
+		}
+
+		if err != nil {
+			log.Fatalf("Fatal Error: check idle time failed, key '%s', %s", entry.Key, err)
+		}
+
+		if idle < time.Duration(entry.Idle)*time.Second {
+			kept++
+			continue
+		}
+
+		keys = append(keys, entry.Key)
+	}
+
+	if kept > 0 {
+		log.Printf("Warning: %d plan keys are kept, they were accessed since the plan was written", kept)
+	}
+
+	if len(keys) == 0 {
+		return 0
+	}
+
+	return removeKeys(client, keys)
+}
+
+func removeKeys(client *redis.Client, keys []string) int {
+	err := client.Del(keys...).Err()
+
+	if err != nil {
+		log.Fatalf("Fatal Error: delete keys failed, keys '%+v', %s", keys, err)
+	}
+
+	for _, key := range keys {
+		fmt.Println(key)
+	}
+
+	return len(keys)
+}